@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// Links are stored with their canonical slug in the redirect table, additional
+// slugs (aliases) point to the canonical slug and share destination, hits and history.
+
+// linkSlug returns the canonical slug of the link a slug belongs to
+func (a *app) linkSlug(ctx context.Context, slug string) (string, error) {
+	return linkOf(ctx, a.db, slug)
+}
+
+func linkOf(ctx context.Context, db storage, slug string) (link string, err error) {
+	err = db.query(ctx, "SELECT coalesce((SELECT link FROM alias WHERE slug = ?), ?)", func(stmt resultRow) error {
+		link = stmt.ColumnText(0)
+		return nil
+	}, slug, slug)
+	return
+}
+
+// requestSlug returns the normalized slug of the request, resolving aliases to the canonical slug of their link
+func (a *app) requestSlug(r *http.Request) string {
+	slug := a.normalizeSlug(r.FormValue("slug"))
+	if slug == "" {
+		return ""
+	}
+	if link, err := a.linkSlug(r.Context(), slug); err == nil {
+		return link
+	}
+	return slug
+}
+
+// getAliases returns the aliases of a link
+func (a *app) getAliases(ctx context.Context, link string) ([]string, error) {
+	return aliasesOf(ctx, a.db, link)
+}
+
+func aliasesOf(ctx context.Context, db storage, link string) (aliases []string, err error) {
+	err = db.query(ctx, "SELECT slug FROM alias WHERE link = ? ORDER BY slug", func(stmt resultRow) error {
+		aliases = append(aliases, stmt.ColumnText(0))
+		return nil
+	}, link)
+	return
+}
+
+// setAliases replaces the aliases of a link
+func (a *app) setAliases(ctx context.Context, link string, aliases []string) error {
+	a.write.Lock()
+	defer a.write.Unlock()
+	defer a.cache.invalidate(append([]string{link}, aliases...)...)
+	return a.db.transaction(ctx, func(tx storage) error {
+		return replaceAliases(ctx, tx, link, aliases)
+	})
+}
+
+func replaceAliases(ctx context.Context, tx storage, link string, aliases []string) error {
+	if _, err := tx.exec(ctx, "DELETE FROM alias WHERE link = ?", link); err != nil {
+		return err
+	}
+	for _, alias := range aliases {
+		if _, err := tx.exec(ctx, "INSERT INTO alias (slug, link) VALUES (?, ?)", alias, link); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// makeCanonical swaps the canonical slug of a link with one of its aliases
+func (a *app) makeCanonical(ctx context.Context, link, alias string) error {
+	a.write.Lock()
+	defer a.write.Unlock()
+	defer a.cache.invalidate(link, alias)
+	return a.db.transaction(ctx, func(tx storage) error {
+		return swapCanonical(ctx, tx, link, alias)
+	})
+}
+
+func swapCanonical(ctx context.Context, tx storage, link, alias string) error {
+	// The alias entry now keeps the previous canonical slug
+	changes, err := tx.exec(ctx, "UPDATE alias SET slug = ? WHERE slug = ? AND link = ?", link, alias, link)
+	if err != nil {
+		return err
+	}
+	if changes != 1 {
+		return fmt.Errorf("%q is no alias of %q", alias, link)
+	}
+	return moveLink(ctx, tx, link, alias)
+}
+
+// moveLink changes the canonical slug of a link including all references to it
+func moveLink(ctx context.Context, tx storage, from, to string) error {
+	for _, query := range []string{
+		"UPDATE redirect SET slug = ? WHERE slug = ?",
+		"UPDATE revision SET slug = ? WHERE slug = ?",
+		"UPDATE alias SET link = ? WHERE link = ?",
+		"UPDATE click SET slug = ? WHERE slug = ?",
+		"UPDATE click_daily SET slug = ? WHERE slug = ?",
+		"UPDATE click_referrer SET slug = ? WHERE slug = ?",
+	} {
+		if _, err := tx.exec(ctx, query, to, from); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseAliases splits a list of aliases separated by commas or whitespace and
+// checks that they can be used for the link. Aliases that can't be used are
+// returned as requestError.
+func (a *app) parseAliases(ctx context.Context, db storage, link, list string) ([]string, error) {
+	var aliases []string
+	for _, alias := range strings.FieldsFunc(list, func(r rune) bool { return r == ',' || r == ' ' || r == '\n' || r == '\t' || r == '\r' }) {
+		alias = a.normalizeSlug(alias)
+		if alias == link || slices.Contains(aliases, alias) {
+			continue
+		}
+		if a.slugReserved(alias) {
+			return nil, requestError{fmt.Errorf("alias %q: %s", alias, errReservedSlug)}
+		}
+		if err := a.validateSlug(alias); err != nil {
+			return nil, requestError{fmt.Errorf("alias %q: %w", alias, err)}
+		}
+		owner, err := linkOf(ctx, db, alias)
+		if err != nil {
+			return nil, err
+		}
+		if owner != link {
+			if exists, err := slugTaken(ctx, db, alias); err != nil {
+				return nil, err
+			} else if exists {
+				return nil, requestError{fmt.Errorf("alias %q: slug already in use", alias)}
+			}
+		}
+		aliases = append(aliases, alias)
+	}
+	slices.Sort(aliases)
+	return aliases, nil
+}
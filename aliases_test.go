@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAliases(t *testing.T) {
+	t.Run("Aliases share destination, hits and updates", func(t *testing.T) {
+		app := testApp(t)
+		defer closeTestApp(t, app)
+		app.config().Password = "abc"
+
+		router := app.initRouter()
+		update := func(values url.Values) *http.Response {
+			values.Set("password", "abc")
+			req := httptest.NewRequest("POST", "http://example.com/u", strings.NewReader(values.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			return w.Result()
+		}
+		location := func(slug string) string {
+			req := httptest.NewRequest("GET", "http://example.com/"+slug, nil)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			return w.Result().Header.Get("Location")
+		}
+
+		require.NoError(t, app.insertRedirect("main", "https://one.example", typUrl))
+		assert.Equal(t, http.StatusAccepted, update(url.Values{"slug": {"main"}, "new": {"https://one.example"}, "aliases": {"first, second"}}).StatusCode)
+
+		aliases, err := app.getAliases(context.Background(), "main")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"first", "second"}, aliases)
+		assert.Equal(t, "https://one.example", location("first"))
+		assert.Equal(t, "https://one.example", location("second"))
+
+		// aliases are taken slugs
+		exists, err := app.slugExists("first")
+		require.NoError(t, err)
+		assert.True(t, exists)
+
+		// updating via an alias updates the link
+		assert.Equal(t, http.StatusAccepted, update(url.Values{"slug": {"first"}, "new": {"https://two.example"}}).StatusCode)
+		assert.Equal(t, "https://two.example", location("main"))
+		aliases, err = app.getAliases(context.Background(), "main")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"first", "second"}, aliases)
+
+		// hits of aliases are counted for the link
+		time.Sleep(700 * time.Millisecond)
+		var hits int
+		err = app.db.query(context.Background(), "SELECT hits FROM redirect WHERE slug = ?", func(stmt resultRow) error {
+			hits = stmt.ColumnInt(0)
+			return nil
+		}, "main")
+		require.NoError(t, err)
+		assert.Equal(t, 3, hits)
+
+		// the list shows the aliases
+		req := httptest.NewRequest("GET", "http://example.com/l?password=abc", nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		body, _ := io.ReadAll(w.Result().Body)
+		assert.Contains(t, string(body), "(first, second)")
+
+		// slugs of other links and reserved slugs can't be aliases
+		assert.Equal(t, http.StatusBadRequest, update(url.Values{"slug": {"main"}, "new": {"https://two.example"}, "aliases": {"source"}}).StatusCode)
+		assert.Equal(t, http.StatusBadRequest, update(url.Values{"slug": {"main"}, "new": {"https://two.example"}, "aliases": {"l"}}).StatusCode)
+		assert.Equal(t, http.StatusBadRequest, update(url.Values{"slug": {"source"}, "new": {"https://three.example"}, "aliases": {"second"}}).StatusCode)
+
+		// rejected updates don't change anything
+		assert.Equal(t, http.StatusBadRequest, update(url.Values{"slug": {"main"}, "new": {"https://three.example"}, "aliases": {"third"}, "canonical": {"other"}}).StatusCode)
+		assert.Equal(t, "https://two.example", location("main"))
+		assert.Empty(t, location("third"))
+		assert.Equal(t, http.StatusNotFound, update(url.Values{"slug": {"missing"}, "new": {"https://three.example"}}).StatusCode)
+
+		// make an alias the canonical slug
+		assert.Equal(t, http.StatusBadRequest, update(url.Values{"slug": {"main"}, "new": {"https://two.example"}, "canonical": {"other"}}).StatusCode)
+		assert.Equal(t, http.StatusAccepted, update(url.Values{"slug": {"main"}, "new": {"https://two.example"}, "canonical": {"second"}}).StatusCode)
+		link, err := app.linkSlug(context.Background(), "main")
+		require.NoError(t, err)
+		assert.Equal(t, "second", link)
+		aliases, err = app.getAliases(context.Background(), "second")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"first", "main"}, aliases)
+		revisions, err := app.getRevisions(context.Background(), "second")
+		require.NoError(t, err)
+		assert.Len(t, revisions, 1)
+
+		// an empty list removes the aliases
+		assert.Equal(t, http.StatusAccepted, update(url.Values{"slug": {"second"}, "new": {"https://two.example"}, "aliases": {""}}).StatusCode)
+		assert.Empty(t, location("first"))
+		assert.Equal(t, "https://two.example", location("second"))
+	})
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+type backupConfig struct {
+	// Directory for scheduled backups
+	Dir string `mapstructure:"dir"`
+	// How often a backup is made, 0 disables scheduled backups
+	Interval time.Duration `mapstructure:"interval"`
+	// Number of scheduled backups to keep, 0 keeps all
+	Keep int `mapstructure:"keep"`
+	// Upload scheduled backups to S3-compatible object storage
+	S3 s3Config `mapstructure:"s3"`
+}
+
+const backupTimeFormat = "20060102-150405"
+
+var errBackupUnsupported = errors.New("backups are only supported for SQLite, use the tools of your database server instead")
+
+var errDatabaseInUse = errors.New("the database is in use, stop GoShort before restoring")
+
+// backupName returns the file name of a backup made at the given time
+func backupName(t time.Time) string {
+	return "goshort-" + t.UTC().Format(backupTimeFormat) + ".db"
+}
+
+// backup writes a consistent snapshot of the SQLite database to a new or empty file
+func (s *sqliteStorage) backup(ctx context.Context, path string) error {
+	conn, put, err := s.take(ctx)
+	if err != nil {
+		return err
+	}
+	defer put()
+	return sqlitex.Execute(conn, "VACUUM INTO ?", &sqlitex.ExecOptions{Args: []any{path}})
+}
+
+// backup writes a snapshot of the database to path, which must not exist yet.
+// The snapshot is written to a temporary file first, so path is always complete.
+func (a *app) backup(ctx context.Context, path string) error {
+	s, ok := a.db.(*sqliteStorage)
+	if !ok {
+		return errBackupUnsupported
+	}
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("%s already exists", path)
+	}
+	tmp := path + ".tmp"
+	_ = os.Remove(tmp)
+	if err := s.backup(ctx, tmp); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// validateBackup checks that a file is an intact GoShort database with a schema this version can use
+func validateBackup(path string) (err error) {
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+	conn, err := sqlite.OpenConn(path, sqlite.OpenReadOnly)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := conn.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+	pragma := func(name string) (value string, err error) {
+		err = sqlitex.ExecuteTransient(conn, "PRAGMA "+name, &sqlitex.ExecOptions{
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				value = stmt.ColumnText(0)
+				return nil
+			},
+		})
+		if err != nil {
+			return "", fmt.Errorf("%s is no SQLite database: %w", path, err)
+		}
+		return value, nil
+	}
+	appID, err := pragma("application_id")
+	if err != nil {
+		return err
+	}
+	if appID != strconv.Itoa(int(sqliteSchema.AppID)) {
+		return fmt.Errorf("%s is no GoShort database (application ID %s)", path, appID)
+	}
+	version, err := pragma("user_version")
+	if err != nil {
+		return err
+	}
+	if v, _ := strconv.Atoi(version); v < 1 || v > len(sqliteSchema.Migrations) {
+		return fmt.Errorf("%s has an unsupported schema version %s (expected 1 to %d)", path, version, len(sqliteSchema.Migrations))
+	}
+	check, err := pragma("quick_check")
+	if err != nil {
+		return err
+	}
+	if check != "ok" {
+		return fmt.Errorf("%s is corrupt: %s", path, check)
+	}
+	return nil
+}
+
+// checkNotInUse returns errDatabaseInUse if another process has the SQLite
+// database open. The connections of a running GoShort keep the database in WAL
+// mode locked, so an exclusive lock can't be taken then.
+func checkNotInUse(path string) error {
+	conn, err := sqlite.OpenConn(path, sqlite.OpenReadWrite)
+	if err != nil {
+		// A missing or damaged database can't be in use
+		return nil
+	}
+	defer conn.Close()
+	for _, query := range []string{"PRAGMA busy_timeout = 0", "PRAGMA locking_mode = EXCLUSIVE", "BEGIN EXCLUSIVE", "COMMIT"} {
+		if err := sqlitex.ExecuteTransient(conn, query, nil); err != nil {
+			if code := sqlite.ErrCode(err).ToPrimary(); code == sqlite.ResultBusy || code == sqlite.ResultLocked {
+				return errDatabaseInUse
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+// restoreBackup replaces the database at dbPath with a validated backup.
+// It refuses to replace a database that GoShort is running with.
+func restoreBackup(backupPath, dbPath string) error {
+	if err := validateBackup(backupPath); err != nil {
+		return err
+	}
+	if err := checkNotInUse(dbPath); err != nil {
+		return err
+	}
+	src, err := os.Open(backupPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	_ = os.MkdirAll(filepath.Dir(dbPath), os.ModePerm)
+	tmp := dbPath + ".restore"
+	dst, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		_ = dst.Close()
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	// The write-ahead log belongs to the replaced database
+	for _, suffix := range []string{"-wal", "-shm"} {
+		if err := os.Remove(dbPath + suffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return os.Rename(tmp, dbPath)
+}
+
+// scheduledBackup writes a new backup to the backup directory and deletes old backups
+func (a *app) scheduledBackup(ctx context.Context) (string, error) {
+	cfg := a.config().Backup
+	if err := os.MkdirAll(cfg.Dir, os.ModePerm); err != nil {
+		return "", err
+	}
+	path := filepath.Join(cfg.Dir, backupName(time.Now()))
+	if err := a.backup(ctx, path); err != nil {
+		return "", err
+	}
+	if err := pruneBackups(cfg.Dir, cfg.Keep); err != nil {
+		return path, err
+	}
+	if cfg.S3.Endpoint != "" {
+		if err := uploadBackup(ctx, cfg.S3, path); err != nil {
+			return path, fmt.Errorf("upload to S3: %w", err)
+		}
+	}
+	return path, nil
+}
+
+// listBackups returns the file names of the backups in a directory, oldest first
+func listBackups(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if _, ok := backupTime(e.Name()); ok && e.Type().IsRegular() {
+			names = append(names, e.Name())
+		}
+	}
+	// The timestamps sort chronologically
+	slices.Sort(names)
+	return names, nil
+}
+
+// backupTime returns the time a backup was made from its file name
+func backupTime(name string) (time.Time, bool) {
+	ts, ok := strings.CutPrefix(name, "goshort-")
+	if !ok {
+		return time.Time{}, false
+	}
+	ts, ok = strings.CutSuffix(ts, ".db")
+	if !ok {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(backupTimeFormat, ts)
+	return t, err == nil
+}
+
+// expiredBackups returns the backups of a list sorted oldest first that exceed the number to keep
+func expiredBackups(names []string, keep int) []string {
+	if keep <= 0 || len(names) <= keep {
+		return nil
+	}
+	return names[:len(names)-keep]
+}
+
+// pruneBackups deletes all but the newest keep backups in a directory
+func pruneBackups(dir string, keep int) error {
+	names, err := listBackups(dir)
+	if err != nil {
+		return err
+	}
+	for _, name := range expiredBackups(names, keep) {
+		if err := os.Remove(filepath.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// startBackupScheduler starts a background worker that makes a backup whenever the
+// newest backup in the backup directory is older than the configured interval.
+func (a *app) startBackupScheduler() {
+	cfg := a.config().Backup
+	if cfg.Interval <= 0 {
+		return
+	}
+	if _, ok := a.db.(*sqliteStorage); !ok {
+		log.Println("Scheduled backups disabled:", errBackupUnsupported.Error())
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Go(func() {
+		for {
+			wait := time.Duration(0)
+			names, err := listBackups(cfg.Dir)
+			if err != nil {
+				log.Println("Failed to list backups:", err.Error())
+			} else if len(names) > 0 {
+				last, _ := backupTime(names[len(names)-1])
+				wait = time.Until(last.Add(cfg.Interval))
+			}
+			if wait > 0 {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(wait):
+				}
+			}
+			path, err := a.scheduledBackup(ctx)
+			if err != nil && path != "" {
+				// The local backup was made, so don't retry before the next interval
+				log.Println("Backed up database to", path, "but failed to finish:", err.Error())
+				continue
+			} else if err != nil {
+				log.Println("Failed to back up database:", err.Error())
+				// Try again later instead of immediately
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(min(cfg.Interval, time.Hour)):
+				}
+				continue
+			}
+			log.Println("Backed up database to", path)
+		}
+	})
+	a.shutdown.Add(func() {
+		cancel()
+		wg.Wait()
+	})
+}
+
+// backupHandler downloads a snapshot of the database
+func (a *app) backupHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := a.db.(*sqliteStorage); !ok {
+		http.Error(w, errBackupUnsupported.Error(), http.StatusNotImplemented)
+		return
+	}
+	dir, err := os.MkdirTemp(filepath.Dir(a.config().DBPath), "backup")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer os.RemoveAll(dir)
+	now := time.Now()
+	path := filepath.Join(dir, backupName(now))
+	if err := a.backup(r.Context(), path); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", "application/vnd.sqlite3")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+backupName(now)+`"`)
+	http.ServeContent(w, r, "", now, f)
+}
+
+// runBackupCommand writes a backup of the configured database to path
+func runBackupCommand(cfg *config, path string) int {
+	if cfg.DatabaseUrl != "" {
+		fmt.Fprintln(os.Stderr, errBackupUnsupported.Error())
+		return 1
+	}
+	db, err := openSQLite(cfg.DBPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error opening database:", err.Error())
+		return 1
+	}
+	defer db.close()
+	a := newApp(cfg)
+	a.db = db
+	if err := a.backup(context.Background(), path); err != nil {
+		fmt.Fprintln(os.Stderr, "Backup failed:", err.Error())
+		return 1
+	}
+	fmt.Println("Backed up database to", path)
+	return 0
+}
+
+// runRestoreCommand replaces the configured database with a backup
+func runRestoreCommand(cfg *config, path string) int {
+	if cfg.DatabaseUrl != "" {
+		fmt.Fprintln(os.Stderr, errBackupUnsupported.Error())
+		return 1
+	}
+	if err := restoreBackup(path, cfg.DBPath); err != nil {
+		fmt.Fprintln(os.Stderr, "Restore failed:", err.Error())
+		return 1
+	}
+	fmt.Println("Restored database from", path)
+	return 0
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+func TestBackup(t *testing.T) {
+	t.Run("Backup and restore", func(t *testing.T) {
+		app := testApp(t)
+		if _, ok := app.db.(*sqliteStorage); !ok {
+			closeTestApp(t, app)
+			t.Skip("backups are only supported for SQLite")
+		}
+		require.NoError(t, app.insertRedirect("before", "https://a.example", typUrl))
+		path := filepath.Join(t.TempDir(), "backup.db")
+		require.NoError(t, app.backup(context.Background(), path))
+		assert.ErrorContains(t, app.backup(context.Background(), path), "already exists")
+		require.NoError(t, app.insertRedirect("after", "https://b.example", typUrl))
+		// the database of a running instance isn't replaced
+		assert.ErrorIs(t, restoreBackup(path, app.config().DBPath), errDatabaseInUse)
+		exists, err := app.slugExists("after")
+		require.NoError(t, err)
+		assert.True(t, exists)
+		closeTestApp(t, app)
+
+		require.NoError(t, validateBackup(path))
+		require.NoError(t, restoreBackup(path, app.config().DBPath))
+
+		restored := newApp(&config{DBPath: app.config().DBPath})
+		require.NoError(t, restored.openDatabase())
+		defer closeTestApp(t, restored)
+		exists, err = restored.slugExists("before")
+		require.NoError(t, err)
+		assert.True(t, exists)
+		exists, err = restored.slugExists("after")
+		require.NoError(t, err)
+		assert.False(t, exists)
+	})
+	t.Run("Invalid backups are rejected", func(t *testing.T) {
+		dir := t.TempDir()
+		dbPath := filepath.Join(dir, "data.db")
+
+		text := filepath.Join(dir, "text.db")
+		require.NoError(t, os.WriteFile(text, []byte("no database"), 0o644))
+		assert.ErrorContains(t, restoreBackup(text, dbPath), "no SQLite database")
+
+		other := filepath.Join(dir, "other.db")
+		conn, err := sqlite.OpenConn(other)
+		require.NoError(t, err)
+		require.NoError(t, sqlitex.ExecuteTransient(conn, "CREATE TABLE test (id integer)", nil))
+		require.NoError(t, conn.Close())
+		assert.ErrorContains(t, restoreBackup(other, dbPath), "no GoShort database")
+
+		assert.Error(t, restoreBackup(filepath.Join(dir, "missing.db"), dbPath))
+		_, err = os.Stat(dbPath)
+		assert.True(t, os.IsNotExist(err))
+	})
+	t.Run("Scheduled backups are rotated", func(t *testing.T) {
+		app := testApp(t)
+		defer closeTestApp(t, app)
+		if _, ok := app.db.(*sqliteStorage); !ok {
+			t.Skip("backups are only supported for SQLite")
+		}
+		dir := t.TempDir()
+		app.config().Backup = backupConfig{Dir: dir, Keep: 2}
+		for _, name := range []string{"goshort-20200101-000000.db", "goshort-20210101-000000.db", "notes.txt"} {
+			require.NoError(t, os.WriteFile(filepath.Join(dir, name), nil, 0o644))
+		}
+
+		path, err := app.scheduledBackup(context.Background())
+		require.NoError(t, err)
+		require.NoError(t, validateBackup(path))
+
+		names, err := listBackups(dir)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"goshort-20210101-000000.db", filepath.Base(path)}, names)
+		_, err = os.Stat(filepath.Join(dir, "notes.txt"))
+		assert.NoError(t, err)
+	})
+	t.Run("Download a backup", func(t *testing.T) {
+		app := testApp(t)
+		defer closeTestApp(t, app)
+		app.config().Password = "abc"
+		router := app.initRouter()
+
+		req := httptest.NewRequest("GET", "http://example.com/backup", nil)
+		req.SetBasicAuth("username", "abc")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if _, ok := app.db.(*sqliteStorage); !ok {
+			assert.Equal(t, http.StatusNotImplemented, w.Code)
+			return
+		}
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.True(t, strings.HasPrefix(w.Header().Get("Content-Disposition"), `attachment; filename="goshort-`))
+		body, _ := io.ReadAll(w.Result().Body)
+		assert.True(t, strings.HasPrefix(string(body), "SQLite format 3"))
+
+		// temporary files are removed
+		entries, err := os.ReadDir(filepath.Dir(app.config().DBPath))
+		require.NoError(t, err)
+		for _, e := range entries {
+			assert.False(t, strings.HasPrefix(e.Name(), "backup"), e.Name())
+		}
+	})
+}
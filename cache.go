@@ -0,0 +1,175 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type cacheConfig struct {
+	// Maximum number of cached slugs, 0 disables the cache
+	Size int `mapstructure:"size"`
+	// How long a cached link is used before it is read from the database again
+	TTL time.Duration `mapstructure:"ttl"`
+	// How long unknown slugs are remembered, 0 disables negative caching
+	NegativeTTL time.Duration `mapstructure:"negativeTtl"`
+}
+
+// cachedLink is the result of resolving a requested slug, link is empty for unknown slugs
+type cachedLink struct {
+	slug    string
+	link    string
+	url     string
+	typ     string
+	expires time.Time
+}
+
+// linkCache is an LRU cache of resolved slugs for redirects.
+// A nil linkCache caches nothing.
+type linkCache struct {
+	size        int
+	ttl         time.Duration
+	negativeTTL time.Duration
+	mu          sync.Mutex
+	entries     map[string]*list.Element
+	// most recently used first
+	order *list.List
+	// statistics
+	hits, misses, evictions atomic.Uint64
+}
+
+func newLinkCache(cfg cacheConfig) *linkCache {
+	if cfg.Size <= 0 || cfg.TTL <= 0 {
+		return nil
+	}
+	return &linkCache{
+		size:        cfg.Size,
+		ttl:         cfg.TTL,
+		negativeTTL: cfg.NegativeTTL,
+		entries:     map[string]*list.Element{},
+		order:       list.New(),
+	}
+}
+
+// get returns the cached result for a slug
+func (c *linkCache) get(slug string) (*cachedLink, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[slug]
+	if !ok {
+		c.misses.Add(1)
+		return nil, false
+	}
+	cl := e.Value.(*cachedLink)
+	if time.Now().After(cl.expires) {
+		c.order.Remove(e)
+		delete(c.entries, slug)
+		c.misses.Add(1)
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	c.hits.Add(1)
+	return cl, true
+}
+
+// put caches the result for a slug, evicting the least recently used entry if the cache is full
+func (c *linkCache) put(cl *cachedLink) {
+	if c == nil {
+		return
+	}
+	ttl := c.ttl
+	if cl.link == "" {
+		if c.negativeTTL <= 0 {
+			return
+		}
+		ttl = c.negativeTTL
+	}
+	cl.expires = time.Now().Add(ttl)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[cl.slug]; ok {
+		e.Value = cl
+		c.order.MoveToFront(e)
+		return
+	}
+	c.entries[cl.slug] = c.order.PushFront(cl)
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cachedLink).slug)
+		c.evictions.Add(1)
+	}
+}
+
+// invalidate removes the given slugs and all aliases resolving to them
+func (c *linkCache) invalidate(slugs ...string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for e := c.order.Front(); e != nil; {
+		next := e.Next()
+		cl := e.Value.(*cachedLink)
+		for _, slug := range slugs {
+			if cl.slug == slug || cl.link == slug {
+				c.order.Remove(e)
+				delete(c.entries, cl.slug)
+				break
+			}
+		}
+		e = next
+	}
+}
+
+// clear removes all entries, for changes that affect many slugs
+func (c *linkCache) clear() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = map[string]*list.Element{}
+	c.order.Init()
+}
+
+func (c *linkCache) len() int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+// metricsHandler writes the cache statistics in the Prometheus text format
+func (a *app) metricsHandler(w http.ResponseWriter, _ *http.Request) {
+	c := a.cache
+	var hits, misses, evictions uint64
+	if c != nil {
+		hits, misses, evictions = c.hits.Load(), c.misses.Load(), c.evictions.Load()
+	}
+	ratio := 0.0
+	if hits+misses > 0 {
+		ratio = float64(hits) / float64(hits+misses)
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, m := range []struct {
+		name, typ, help string
+		value           any
+	}{
+		{"goshort_cache_hits_total", "counter", "Redirects served from the cache", hits},
+		{"goshort_cache_misses_total", "counter", "Redirects that needed a database query", misses},
+		{"goshort_cache_evictions_total", "counter", "Entries evicted because the cache was full", evictions},
+		{"goshort_cache_entries", "gauge", "Entries in the cache", c.len()},
+		{"goshort_cache_hit_ratio", "gauge", "Share of redirects served from the cache", ratio},
+	} {
+		_, _ = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", m.name, m.help, m.name, m.typ, m.name, m.value)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLinkCache(t *testing.T) {
+	t.Run("Redirects are cached and invalidated on changes", func(t *testing.T) {
+		app := testApp(t)
+		defer closeTestApp(t, app)
+		app.config().Password = "abc"
+		app.cache = newLinkCache(cacheConfig{Size: 10, TTL: time.Hour, NegativeTTL: time.Hour})
+		router := app.initRouter()
+
+		location := func(slug string) string {
+			req := httptest.NewRequest("GET", "http://example.com/"+slug, nil)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			if w.Code == http.StatusNotFound {
+				return ""
+			}
+			return w.Header().Get("Location")
+		}
+
+		// unknown slugs are cached until the slug is created
+		assert.Equal(t, "", location("new"))
+		assert.Equal(t, "", location("new"))
+		require.NoError(t, app.insertRedirect("new", "https://a.example", typUrl))
+		assert.Equal(t, "https://a.example", location("new"))
+		assert.Equal(t, "https://a.example", location("new"))
+		assert.Equal(t, uint64(2), app.cache.hits.Load())
+		assert.Equal(t, uint64(2), app.cache.misses.Load())
+
+		// changes in the database are only seen after invalidation
+		_, err := app.db.exec(context.Background(), "UPDATE redirect SET url = ? WHERE slug = ?", "https://b.example", "new")
+		require.NoError(t, err)
+		assert.Equal(t, "https://a.example", location("new"))
+		require.NoError(t, app.updateSlug(context.Background(), "https://c.example", typUrl, "new"))
+		assert.Equal(t, "https://c.example", location("new"))
+
+		// aliases are invalidated with their link
+		require.NoError(t, app.setAliases(context.Background(), "new", []string{"alias"}))
+		assert.Equal(t, "https://c.example", location("alias"))
+		require.NoError(t, app.deleteSlug("new"))
+		assert.Equal(t, "", location("new"))
+		assert.Equal(t, "", location("alias"))
+		require.NoError(t, app.restoreSlug("new"))
+		assert.Equal(t, "https://c.example", location("alias"))
+
+		// hits are still counted for cached links
+		time.Sleep(700 * time.Millisecond)
+		var hits int
+		err = app.db.query(context.Background(), "SELECT hits FROM redirect WHERE slug = ?", func(stmt resultRow) error {
+			hits = stmt.ColumnInt(0)
+			return nil
+		}, "new")
+		require.NoError(t, err)
+		assert.Equal(t, 6, hits)
+
+		// statistics
+		req := httptest.NewRequest("GET", "http://example.com/metrics", nil)
+		req.SetBasicAuth("username", "abc")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		body, _ := io.ReadAll(w.Result().Body)
+		assert.Contains(t, string(body), "goshort_cache_hits_total 3\n")
+		assert.Contains(t, string(body), "goshort_cache_hit_ratio ")
+	})
+	t.Run("Least recently used entries are evicted and expire", func(t *testing.T) {
+		c := newLinkCache(cacheConfig{Size: 2, TTL: time.Hour})
+		c.put(&cachedLink{slug: "a", link: "a"})
+		c.put(&cachedLink{slug: "b", link: "b"})
+		_, ok := c.get("a")
+		assert.True(t, ok)
+		c.put(&cachedLink{slug: "c", link: "c"})
+		_, ok = c.get("b")
+		assert.False(t, ok)
+		_, ok = c.get("a")
+		assert.True(t, ok)
+		assert.Equal(t, 2, c.len())
+		assert.Equal(t, uint64(1), c.evictions.Load())
+
+		// unknown slugs aren't cached without negative TTL
+		c.put(&cachedLink{slug: "unknown"})
+		_, ok = c.get("unknown")
+		assert.False(t, ok)
+
+		c.put(&cachedLink{slug: "a", link: "a"})
+		c.entries["a"].Value.(*cachedLink).expires = time.Now().Add(-time.Second)
+		_, ok = c.get("a")
+		assert.False(t, ok)
+
+		assert.Nil(t, newLinkCache(cacheConfig{}))
+	})
+}
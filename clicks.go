@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type clicksConfig struct {
+	// How long single clicks are kept before they are rolled up into daily aggregates, 0 keeps them forever
+	Retention time.Duration `mapstructure:"retention"`
+	// Number of referrers kept per link and day when rolling up
+	TopReferrers int `mapstructure:"topReferrers"`
+}
+
+// dayDuration is the length of the UTC days that clicks are counted by
+const dayDuration = 24 * time.Hour
+
+// secondsPerDay is the length of a day in unix time
+const secondsPerDay = int64(dayDuration / time.Second)
+
+// dayNumber returns the number of the UTC day of t since the unix epoch, like
+// the days of the statistics and visitor salts
+func dayNumber(t time.Time) int64 {
+	return t.Unix() / secondsPerDay
+}
+
+// click is a single request to a short link
+type click struct {
+	slug string
+	time int64
+	// hash of the client that changes daily, to count unique visitors without storing IP addresses
+	visitor string
+	// host of the referring page
+	referrer string
+}
+
+func (a *app) newClick(r *http.Request, slug string) click {
+	now := time.Now().UTC()
+	mac := hmac.New(sha256.New, a.visitorSalt(r.Context(), dayNumber(now)))
+	_, _ = io.WriteString(mac, a.clientIP(r)+"\n"+r.UserAgent())
+	var referrer string
+	if u, err := url.Parse(r.Referer()); err == nil {
+		referrer = u.Hostname()
+	}
+	return click{slug: slug, time: now.Unix(), visitor: hex.EncodeToString(mac.Sum(nil)[:8]), referrer: referrer}
+}
+
+// visitorSalt returns the secret key of the day for visitor hashes. Without it
+// the few possible IP addresses and user agents could be tried to reverse the
+// hashes. It is shared through the database, so restarts and replicas count
+// the same visitors, and deleted after the day, so hashes of previous days
+// can't be reversed anymore.
+func (a *app) visitorSalt(ctx context.Context, day int64) []byte {
+	a.saltMu.Lock()
+	defer a.saltMu.Unlock()
+	if a.salt != nil && a.saltDay == day {
+		return a.salt
+	}
+	// A canceled request shouldn't fail the salt for the next clicks
+	ctx = context.WithoutCancel(ctx)
+	var salt []byte
+	a.write.Lock()
+	err := a.db.transaction(ctx, func(tx storage) error {
+		if _, err := tx.exec(ctx, "DELETE FROM visitor_salt WHERE day < ?", day); err != nil {
+			return err
+		}
+		if _, err := tx.exec(ctx, "INSERT INTO visitor_salt (day, salt) VALUES (?, ?) ON CONFLICT (day) DO NOTHING", day, rand.Text()); err != nil {
+			return err
+		}
+		return tx.query(ctx, "SELECT salt FROM visitor_salt WHERE day = ?", func(stmt resultRow) error {
+			salt = []byte(stmt.ColumnText(0))
+			return nil
+		}, day)
+	})
+	a.write.Unlock()
+	if err != nil {
+		// The click counts as a new visitor then, the salt is tried again with the next click
+		log.Println("Failed to store the visitor salt:", err.Error())
+		return []byte(rand.Text())
+	}
+	a.salt, a.saltDay = salt, day
+	return salt
+}
+
+// rollupClicks folds the single clicks of the days before the day of the given
+// time into daily aggregates per link and deletes them. Days are always
+// aggregated at once.
+func (a *app) rollupClicks(before time.Time) (rolledUp int, err error) {
+	a.write.Lock()
+	defer a.write.Unlock()
+	return a.db.rollupClicks(context.Background(), dayNumber(before), max(a.config().Clicks.TopReferrers, 1))
+}
+
+// startClickRollup starts a background worker that rolls up single clicks
+// which are older than the configured retention.
+func (a *app) startClickRollup() {
+	if a.config().Clicks.Retention <= 0 {
+		return
+	}
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Go(func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+		for {
+			rolledUp, err := a.rollupClicks(time.Now().Add(-a.config().Clicks.Retention))
+			if err != nil {
+				log.Println("Failed to roll up clicks:", err.Error())
+			} else if rolledUp > 0 {
+				log.Println("Rolled up", rolledUp, "clicks into daily statistics")
+			}
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	})
+	a.shutdown.Add(func() {
+		close(stop)
+		wg.Wait()
+	})
+}
+
+func (a *app) statsHandler(w http.ResponseWriter, r *http.Request) {
+	slug := a.requestSlug(r)
+	if slug == "" {
+		http.Error(w, "Specify the slug to show the statistics for", http.StatusBadRequest)
+		return
+	}
+	if e, err := a.slugExists(slug); err != nil || !e {
+		http.NotFound(w, r)
+		return
+	}
+	days := 30
+	if d, err := strconv.Atoi(r.FormValue("days")); err == nil && d > 0 {
+		days = d
+	}
+	fromDay := dayNumber(time.Now()) - int64(days-1)
+
+	type row struct {
+		Date     string
+		Clicks   int64
+		Visitors int64
+	}
+	var list []row
+	var totalClicks int64
+	stats, err := a.db.dailyClicks(r.Context(), slug, fromDay)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, d := range stats {
+		list = append(list, row{
+			Date:     time.Unix(d.day*secondsPerDay, 0).UTC().Format(time.DateOnly),
+			Clicks:   d.clicks,
+			Visitors: d.visitors,
+		})
+		totalClicks += d.clicks
+	}
+
+	type referrer struct {
+		Host   string
+		Clicks int64
+	}
+	var referrers []referrer
+	top, err := a.db.topReferrers(r.Context(), slug, fromDay, 10)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, ref := range top {
+		referrers = append(referrers, referrer{Host: ref.host, Clicks: ref.clicks})
+	}
+
+	err = statsTemplate.Execute(w, &templateData{Style: template.CSS(styleCSS), Data: map[string]any{
+		"Slug":      slug,
+		"Days":      days,
+		"Clicks":    totalClicks,
+		"List":      list,
+		"Referrers": referrers,
+	}})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClicks(t *testing.T) {
+	t.Run("Clicks are rolled up and shown on the stats page", func(t *testing.T) {
+		app := testApp(t)
+		defer closeTestApp(t, app)
+		app.config().Password = "abc"
+		app.config().Clicks.TopReferrers = 1
+		router := app.initRouter()
+		ctx := context.Background()
+
+		count := func(query string, args ...any) (n int) {
+			err := app.db.query(ctx, query, func(stmt resultRow) error {
+				n = stmt.ColumnInt(0)
+				return nil
+			}, args...)
+			require.NoError(t, err)
+			return
+		}
+
+		// clicks of today
+		for _, referrer := range []string{"https://blog.example/post", "https://blog.example/other", ""} {
+			req := httptest.NewRequest("GET", "http://example.com/source", nil)
+			req.Header.Set("Referer", referrer)
+			router.ServeHTTP(httptest.NewRecorder(), req)
+		}
+		time.Sleep(700 * time.Millisecond)
+		assert.Equal(t, 3, count("SELECT count(*) FROM click WHERE slug = ?", "source"))
+		assert.Equal(t, 1, count("SELECT count(DISTINCT visitor) FROM click WHERE slug = ?", "source"))
+		assert.Equal(t, 3, count("SELECT hits FROM redirect WHERE slug = ?", "source"))
+
+		// clicks of two days ago
+		old := time.Now().UTC().Truncate(dayDuration).Add(-2*dayDuration + time.Hour).Unix()
+		for _, c := range []click{
+			{slug: "source", time: old, visitor: "a", referrer: "news.example"},
+			{slug: "source", time: old + 1, visitor: "a", referrer: "news.example"},
+			{slug: "source", time: old + 2, visitor: "b", referrer: "blog.example"},
+		} {
+			_, err := app.db.exec(ctx, "INSERT INTO click (slug, created, visitor, referrer) VALUES (?, ?, ?, ?)", c.slug, c.time, c.visitor, c.referrer)
+			require.NoError(t, err)
+		}
+
+		rolledUp, err := app.rollupClicks(time.Now())
+		require.NoError(t, err)
+		assert.Equal(t, 3, rolledUp)
+		assert.Equal(t, 3, count("SELECT count(*) FROM click"))
+		assert.Equal(t, 3, count("SELECT clicks FROM click_daily WHERE slug = ? AND day = ?", "source", dayNumber(time.Unix(old, 0))))
+		assert.Equal(t, 2, count("SELECT visitors FROM click_daily WHERE slug = ? AND day = ?", "source", dayNumber(time.Unix(old, 0))))
+		// only the top referrer is kept
+		assert.Equal(t, 1, count("SELECT count(*) FROM click_referrer"))
+		assert.Equal(t, 2, count("SELECT clicks FROM click_referrer WHERE referrer = ?", "news.example"))
+
+		// the stats page combines rolled up and single clicks
+		req := httptest.NewRequest("GET", "http://example.com/stats?slug=source", nil)
+		req.SetBasicAuth("username", "abc")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		body, _ := io.ReadAll(w.Result().Body)
+		s := string(body)
+		assert.Contains(t, s, "6 clicks in the last 30 days")
+		assert.Contains(t, s, "<td>"+time.Unix(old, 0).UTC().Format(time.DateOnly)+"</td>\n<td>3</td>\n<td>2</td>")
+		assert.Contains(t, s, "<td>"+time.Now().UTC().Format(time.DateOnly)+"</td>\n<td>3</td>\n<td>1</td>")
+		assert.Contains(t, s, `title="blog.example">blog.example</td>`+"\n<td>2</td>")
+		assert.Contains(t, s, `title="news.example">news.example</td>`+"\n<td>2</td>")
+
+		// older days are outside of a shorter range
+		req = httptest.NewRequest("GET", "http://example.com/stats?slug=source&days=1", nil)
+		req.SetBasicAuth("username", "abc")
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		body, _ = io.ReadAll(w.Result().Body)
+		assert.Contains(t, string(body), "3 clicks in the last 1 days")
+
+		// statistics move with renamed links
+		require.NoError(t, app.renameSlug(ctx, "source", "code", false))
+		assert.Equal(t, 3, count("SELECT count(*) FROM click WHERE slug = ?", "code"))
+		assert.Equal(t, 1, count("SELECT count(*) FROM click_daily WHERE slug = ?", "code"))
+	})
+	t.Run("Visitor hashes use a secret salt of the day", func(t *testing.T) {
+		app := testApp(t)
+		defer closeTestApp(t, app)
+		ctx := context.Background()
+		_, err := app.db.exec(ctx, "INSERT INTO visitor_salt (day, salt) VALUES (?, ?)", 1, "old")
+		require.NoError(t, err)
+
+		req := httptest.NewRequest("GET", "http://example.com/source", nil)
+		req.Header.Set("User-Agent", "Browser")
+		visitor := app.newClick(req, "source").visitor
+		assert.Len(t, visitor, 16)
+		assert.Equal(t, visitor, app.newClick(req, "source").visitor)
+		other := httptest.NewRequest("GET", "http://example.com/source", nil)
+		other.Header.Set("User-Agent", "Other browser")
+		assert.NotEqual(t, visitor, app.newClick(other, "source").visitor)
+
+		// after a restart the salt of the day is read from the database
+		app.salt = nil
+		assert.Equal(t, visitor, app.newClick(req, "source").visitor)
+
+		// salts of previous days are deleted
+		var days []int64
+		require.NoError(t, app.db.query(ctx, "SELECT day FROM visitor_salt", func(stmt resultRow) error {
+			days = append(days, stmt.ColumnInt64(0))
+			return nil
+		}))
+		assert.Equal(t, []int64{dayNumber(time.Now())}, days)
+	})
+}
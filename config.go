@@ -0,0 +1,241 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// Settings are read from (highest precedence first) command-line flags,
+// GOSHORT_* environment variables, the config file and the defaults.
+
+const redacted = "[redacted]"
+
+func setConfigDefaults(v *viper.Viper) {
+	v.SetDefault("dbPath", "data/goshort.db")
+	v.SetDefault("port", 8080)
+	v.SetDefault("trashRetention", 30*24*time.Hour)
+	v.SetDefault("healthCheck.timeout", 10*time.Second)
+	v.SetDefault("healthCheck.concurrency", 4)
+	v.SetDefault("healthCheck.rateLimit", 2)
+	v.SetDefault("rateLimit.redirects.rate", 20)
+	v.SetDefault("rateLimit.redirects.burst", 100)
+	v.SetDefault("rateLimit.authenticated.rate", 5)
+	v.SetDefault("rateLimit.authenticated.burst", 50)
+	v.SetDefault("rateLimit.failedAuth.rate", 0.1)
+	v.SetDefault("rateLimit.failedAuth.burst", 10)
+	v.SetDefault("cache.size", 1000)
+	v.SetDefault("cache.ttl", time.Minute)
+	v.SetDefault("cache.negativeTtl", 10*time.Second)
+	v.SetDefault("backup.dir", "data/backups")
+	v.SetDefault("backup.keep", 7)
+	v.SetDefault("clicks.retention", 90*24*time.Hour)
+	v.SetDefault("clicks.topReferrers", 10)
+	v.SetDefault("session.lifetime", defaultSessionLifetime)
+	v.SetDefault("oidc.name", "single sign-on")
+	v.SetDefault("oidc.scopes", []string{"email"})
+	v.SetDefault("oidc.groupsClaim", "groups")
+}
+
+// configField is a setting of the config struct with its full key like healthCheck.interval
+type configField struct {
+	key    string
+	typ    reflect.Type
+	secret bool
+}
+
+// configFields lists all settings of the config struct
+func configFields(t reflect.Type, prefix string) (fields []configField) {
+	for i := range t.NumField() {
+		f := t.Field(i)
+		key := prefix + f.Tag.Get("mapstructure")
+		if f.Type.Kind() == reflect.Struct && f.Type != reflect.TypeFor[time.Duration]() {
+			fields = append(fields, configFields(f.Type, key+".")...)
+			continue
+		}
+		fields = append(fields, configField{key: key, typ: f.Type, secret: f.Tag.Get("secret") == "true"})
+	}
+	return
+}
+
+// envName returns the environment variable for a key, healthCheck.interval becomes GOSHORT_HEALTH_CHECK_INTERVAL
+func envName(key string) string {
+	return "GOSHORT_" + strings.ToUpper(strings.ReplaceAll(splitWords(key, "_"), ".", "_"))
+}
+
+// flagName returns the command-line flag for a key, healthCheck.interval becomes health-check.interval
+func flagName(key string) string {
+	return strings.ToLower(splitWords(key, "-"))
+}
+
+// splitWords separates the words of camel case names, keeping abbreviations like URL together
+func splitWords(s, sep string) string {
+	var b strings.Builder
+	runes := []rune(s)
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) && runes[i-1] != '.' &&
+			(unicode.IsLower(runes[i-1]) || i+1 < len(runes) && unicode.IsLower(runes[i+1])) {
+			b.WriteString(sep)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// loadConfig reads the config from flags, environment and config file and
+// returns it together with the remaining command-line arguments.
+func loadConfig(v *viper.Viper, args []string) (cfg *config, rest []string, err error) {
+	setConfigDefaults(v)
+
+	flags := pflag.NewFlagSet("goshort", pflag.ContinueOnError)
+	configFile := flags.String("config", "", "path to the config file (default config.{yaml,json,toml} in ./config or .)")
+	for _, f := range configFields(reflect.TypeFor[config](), "") {
+		if err := v.BindEnv(f.key, envName(f.key)); err != nil {
+			return nil, nil, err
+		}
+		name, usage := flagName(f.key), "sets "+f.key
+		switch f.typ.Kind() {
+		case reflect.Bool:
+			flags.Bool(name, false, usage)
+		case reflect.Int:
+			flags.Int(name, 0, usage)
+		case reflect.Float64:
+			flags.Float64(name, 0, usage)
+		case reflect.Int64:
+			flags.Duration(name, 0, usage)
+		case reflect.Slice:
+			flags.StringSlice(name, nil, usage)
+		default:
+			flags.String(name, "", usage)
+		}
+		// Only flags that are actually set are used
+		if err := v.BindPFlag(f.key, flags.Lookup(name)); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := flags.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	if *configFile != "" {
+		v.SetConfigFile(*configFile)
+	} else {
+		v.SetConfigName("config")
+		v.AddConfigPath("./config")
+		v.AddConfigPath(".")
+	}
+	if err := v.ReadInConfig(); err != nil {
+		if _, notFound := errors.AsType[viper.ConfigFileNotFoundError](err); !notFound || *configFile != "" {
+			return nil, nil, err
+		}
+	}
+
+	cfg, err = unmarshalConfig(v)
+	return cfg, flags.Args(), err
+}
+
+// unmarshalConfig returns the current config of viper with the password read from the password file
+func unmarshalConfig(v *viper.Viper) (*config, error) {
+	cfg := &config{}
+	if err := v.Unmarshal(cfg); err != nil {
+		return nil, err
+	}
+	if cfg.PasswordFile != "" {
+		password, err := os.ReadFile(cfg.PasswordFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Password = strings.TrimRight(string(password), "\r\n")
+	}
+	return cfg, nil
+}
+
+// validateConfig checks the settings that are required to run
+func validateConfig(cfg *config) error {
+	switch {
+	case cfg.Password == "" && cfg.OIDC.Issuer == "" && cfg.IndieAuth.Me == "":
+		return errors.New("no password (password), single sign-on (oidc.issuer) or IndieAuth (indieAuth.me) is configured")
+	case cfg.OIDC.Issuer != "" && cfg.OIDC.ClientID == "":
+		return errors.New("no OIDC client ID (oidc.clientId) is configured")
+	case cfg.OIDC.Issuer != "" && len(cfg.OIDC.AllowedEmails)+len(cfg.OIDC.AllowedGroups)+len(cfg.OIDC.AdminEmails)+len(cfg.OIDC.AdminGroups) == 0:
+		return errors.New("no users are allowed to log in with single sign-on (oidc.allowedEmails, oidc.allowedGroups, oidc.adminEmails or oidc.adminGroups)")
+	case cfg.IndieAuth.Me != "" && !validProfileURL(cfg.IndieAuth.Me):
+		return errors.New("the IndieAuth profile URL (indieAuth.me) is invalid")
+	case cfg.ShortUrl == "":
+		return errors.New("no short URL (shortUrl) is configured")
+	case cfg.DefaultUrl == "":
+		return errors.New("no default URL (defaultUrl) is configured")
+	case !(cfg.HealthCheck.RateLimit >= 0 && cfg.HealthCheck.RateLimit <= maxCheckRate):
+		return fmt.Errorf("the health check rate limit (healthCheck.rateLimit) has to be between 0 and %g", maxCheckRate)
+	case cfg.Backup.S3.Endpoint != "" && cfg.Backup.S3.Bucket == "":
+		return errors.New("no S3 bucket (backup.s3.bucket) is configured")
+	}
+	return nil
+}
+
+// printConfig writes the effective config with secrets redacted
+func printConfig(w io.Writer, cfg *config) {
+	value := reflect.ValueOf(cfg).Elem()
+	for _, f := range configFields(value.Type(), "") {
+		v := value
+		for part := range strings.SplitSeq(f.key, ".") {
+			v = fieldByTag(v, part)
+		}
+		var s string
+		switch {
+		case f.secret && !v.IsZero():
+			s = redacted
+		case v.Kind() == reflect.Slice:
+			items := make([]string, v.Len())
+			for i := range items {
+				items[i] = fmt.Sprint(v.Index(i).Interface())
+			}
+			s = strings.Join(items, ", ")
+		default:
+			s = fmt.Sprint(v.Interface())
+		}
+		_, _ = fmt.Fprintf(w, "%s: %s\n", f.key, s)
+	}
+}
+
+func fieldByTag(v reflect.Value, tag string) reflect.Value {
+	for i := range v.NumField() {
+		if v.Type().Field(i).Tag.Get("mapstructure") == tag {
+			return v.Field(i)
+		}
+	}
+	return reflect.Value{}
+}
+
+// runCommand runs a command given on the command-line and returns the exit code
+func runCommand(args []string, cfg *config, v *viper.Viper) int {
+	switch {
+	case len(args) == 2 && args[0] == "config" && args[1] == "check":
+		if file := v.ConfigFileUsed(); file != "" {
+			fmt.Println("# config file:", file)
+		}
+		printConfig(os.Stdout, cfg)
+		if err := validateConfig(cfg); err != nil {
+			fmt.Fprintln(os.Stderr, "Invalid config:", err.Error())
+			return 1
+		}
+		return 0
+	case len(args) == 2 && args[0] == "backup":
+		return runBackupCommand(cfg, args[1])
+	case len(args) == 2 && args[0] == "restore":
+		return runRestoreCommand(cfg, args[1])
+	case len(args) <= 2 && args[0] == "restore-s3":
+		return runRestoreS3Command(cfg, strings.Join(args[1:], ""))
+	}
+	fmt.Fprintln(os.Stderr, "Unknown command:", strings.Join(args, " "))
+	fmt.Fprintln(os.Stderr, "Usage: goshort [flags] [config check | backup <file> | restore <file> | restore-s3 [<name>]]")
+	return 2
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_configNames(t *testing.T) {
+	assert.Equal(t, "GOSHORT_HEALTH_CHECK_INTERVAL", envName("healthCheck.interval"))
+	assert.Equal(t, "GOSHORT_SHORT_URL", envName("shortUrl"))
+	assert.Equal(t, "GOSHORT_DB_PATH", envName("dbPath"))
+	assert.Equal(t, "health-check.interval", flagName("healthCheck.interval"))
+	assert.Equal(t, "rate-limit.failed-auth.burst", flagName("rateLimit.failedAuth.burst"))
+}
+
+func TestLoadConfig(t *testing.T) {
+	t.Run("Flags take precedence over environment, config file and defaults", func(t *testing.T) {
+		dir := t.TempDir()
+		configFile := filepath.Join(dir, "goshort.yaml")
+		require.NoError(t, os.WriteFile(configFile, []byte("password: file\nshortUrl: https://file.example\ndefaultUrl: https://file.example\nport: 1000\n"), 0o644))
+		passwordFile := filepath.Join(dir, "secret")
+		require.NoError(t, os.WriteFile(passwordFile, []byte("secret\n"), 0o600))
+
+		t.Setenv("GOSHORT_SHORT_URL", "https://env.example")
+		t.Setenv("GOSHORT_PORT", "2000")
+		t.Setenv("GOSHORT_HEALTH_CHECK_INTERVAL", "1h")
+		t.Setenv("GOSHORT_POLICY_DENY_DOMAINS", "a.example,b.example")
+		t.Setenv("GOSHORT_PASSWORD_FILE", passwordFile)
+
+		cfg, args, err := loadConfig(viper.New(), []string{"--config", configFile, "--port", "3000", "--rate-limit.failed-auth.burst=3", "config", "check"})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"config", "check"}, args)
+		assert.Equal(t, 3000, cfg.Port)
+		assert.Equal(t, "https://env.example", cfg.ShortUrl)
+		assert.Equal(t, "https://file.example", cfg.DefaultUrl)
+		assert.Equal(t, "secret", cfg.Password)
+		assert.Equal(t, time.Hour, cfg.HealthCheck.Interval)
+		assert.Equal(t, []string{"a.example", "b.example"}, cfg.Policy.DenyDomains)
+		assert.Equal(t, 3, cfg.RateLimit.FailedAuth.Burst)
+		assert.Equal(t, 0.1, cfg.RateLimit.FailedAuth.Rate)
+		assert.Equal(t, "data/goshort.db", cfg.DBPath)
+		assert.NoError(t, validateConfig(cfg))
+
+		var out strings.Builder
+		printConfig(&out, cfg)
+		assert.Contains(t, out.String(), "password: [redacted]\n")
+		assert.Contains(t, out.String(), "port: 3000\n")
+		assert.Contains(t, out.String(), "policy.denyDomains: a.example, b.example\n")
+		assert.NotContains(t, out.String(), "password: secret")
+	})
+	t.Run("Missing explicit config file", func(t *testing.T) {
+		_, _, err := loadConfig(viper.New(), []string{"--config", filepath.Join(t.TempDir(), "missing.yaml")})
+		assert.Error(t, err)
+	})
+	t.Run("Health check rate limit out of range", func(t *testing.T) {
+		cfg := &config{Password: "secret", ShortUrl: "https://short.example", DefaultUrl: "https://default.example"}
+		cfg.HealthCheck.RateLimit = 2e9
+		assert.ErrorContains(t, validateConfig(cfg), "healthCheck.rateLimit")
+		cfg.HealthCheck.RateLimit = -1
+		assert.ErrorContains(t, validateConfig(cfg), "healthCheck.rateLimit")
+		cfg.HealthCheck.RateLimit = 1e9
+		assert.NoError(t, validateConfig(cfg))
+	})
+	t.Run("Missing required settings", func(t *testing.T) {
+		t.Chdir(t.TempDir())
+		cfg, _, err := loadConfig(viper.New(), nil)
+		require.NoError(t, err)
+		assert.Error(t, validateConfig(cfg))
+	})
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	csrfField         = "csrf"
+	csrfHeader        = "X-CSRF-Token"
+	csrfTokenLifetime = 24 * time.Hour
+)
+
+// csrfToken returns a token for the forms in the response to the request. Within a
+// session, tokens are signed with the session ID and only valid for the session.
+// Otherwise they are signed with the password, so they are accepted by all instances
+// and invalidated when the password changes.
+func (a *app) csrfToken(r *http.Request) string {
+	created := strconv.FormatInt(time.Now().Unix(), 36)
+	return created + "." + a.csrfSignature(r, created)
+}
+
+func (a *app) csrfSignature(r *http.Request, created string) string {
+	key := a.config().Password
+	if cookie, err := r.Cookie(sessionCookie); err == nil && cookie.Value != "" {
+		key = cookie.Value
+	}
+	if key == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, []byte(key))
+	_, _ = mac.Write([]byte("csrf\n" + created))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// validCSRFToken reports whether the token was created by csrfToken for a request
+// with the same credentials and isn't expired
+func (a *app) validCSRFToken(r *http.Request, token string) bool {
+	created, signature, ok := strings.Cut(token, ".")
+	if !ok || signature == "" {
+		return false
+	}
+	unix, err := strconv.ParseInt(created, 36, 64)
+	if err != nil {
+		return false
+	}
+	if age := time.Since(time.Unix(unix, 0)); age < -time.Minute || age > csrfTokenLifetime {
+		return false
+	}
+	return hmac.Equal([]byte(signature), []byte(a.csrfSignature(r, created)))
+}
+
+// csrfProtected reports whether a request can't be forged by another site. Browsers
+// resend Basic authentication automatically, so such requests need a CSRF token.
+// Requests with a bearer token or the password parameter prove that the client knows
+// the password and requests initiated by the user (like a bookmark or the share
+// menu) have no other site involved.
+func (a *app) csrfProtected(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && a.passwordMatches(token) {
+		return true
+	}
+	if !a.config().DisablePasswordParam && a.passwordMatches(r.FormValue("password")) {
+		return true
+	}
+	if r.Header.Get("Sec-Fetch-Site") == "none" {
+		return true
+	}
+	token := r.Header.Get(csrfHeader)
+	if token == "" {
+		token = r.PostFormValue(csrfField)
+	}
+	return a.validCSRFToken(r, token)
+}
+
+func (a *app) csrfMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !a.csrfProtected(r) {
+			http.Error(w, "Invalid or expired CSRF token, reload the form and try again", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_validCSRFToken(t *testing.T) {
+	app := newApp(&config{Password: "abc"})
+	req := httptest.NewRequest("GET", "http://example.com/s", nil)
+	token := app.csrfToken(req)
+	assert.True(t, app.validCSRFToken(req, token))
+	assert.False(t, app.validCSRFToken(req, ""))
+	assert.False(t, app.validCSRFToken(req, token+"x"))
+	assert.False(t, app.validCSRFToken(req, "invalid"))
+
+	created := strconv.FormatInt(time.Now().Add(-csrfTokenLifetime-time.Minute).Unix(), 36)
+	assert.False(t, app.validCSRFToken(req, created+"."+app.csrfSignature(req, created)))
+
+	// tokens of a session are only valid for the session
+	sessionReq := httptest.NewRequest("GET", "http://example.com/s", nil)
+	sessionReq.AddCookie(&http.Cookie{Name: sessionCookie, Value: "session"})
+	sessionToken := app.csrfToken(sessionReq)
+	assert.True(t, app.validCSRFToken(sessionReq, sessionToken))
+	assert.False(t, app.validCSRFToken(req, sessionToken))
+	assert.False(t, app.validCSRFToken(sessionReq, token))
+
+	// changing the password invalidates the tokens
+	app.config().Password = "def"
+	assert.False(t, app.validCSRFToken(req, token))
+
+	// without password and session there are no valid tokens
+	app.config().Password = ""
+	assert.False(t, app.validCSRFToken(req, app.csrfToken(req)))
+}
+
+func TestCSRF(t *testing.T) {
+	t.Run("Cross-site posts are rejected", func(t *testing.T) {
+		app := testApp(t)
+		defer closeTestApp(t, app)
+		app.config().Password = "abc"
+		router := app.initRouter()
+
+		post := func(form url.Values, header http.Header) int {
+			req := httptest.NewRequest("POST", "http://example.com/s", strings.NewReader(form.Encode()))
+			req.Header = header
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			return w.Code
+		}
+		basicAuth := func() http.Header {
+			req := httptest.NewRequest("GET", "http://example.com", nil)
+			req.SetBasicAuth("username", "abc")
+			return req.Header
+		}
+		exists := func(slug string) bool {
+			e, err := app.slugExists(slug)
+			require.NoError(t, err)
+			return e
+		}
+
+		// a form of another site, the browser sends the Basic authentication along
+		header := basicAuth()
+		header.Set("Origin", "https://evil.example")
+		header.Set("Sec-Fetch-Site", "cross-site")
+		assert.Equal(t, http.StatusForbidden, post(url.Values{"url": {"https://evil.example"}, "slug": {"evil"}}, header))
+		assert.Equal(t, http.StatusForbidden, post(url.Values{"url": {"https://evil.example"}, "slug": {"evil"}, "csrf": {"forged"}}, header))
+		assert.False(t, exists("evil"))
+
+		// the token of the form
+		req := httptest.NewRequest("GET", "http://example.com/s", nil)
+		req.SetBasicAuth("username", "abc")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		match := regexp.MustCompile(`name=csrf value="([^"]+)"`).FindStringSubmatch(w.Body.String())
+		require.Len(t, match, 2)
+		assert.Equal(t, http.StatusCreated, post(url.Values{"url": {"https://form.example"}, "slug": {"form"}, "csrf": {match[1]}}, basicAuth()))
+		header = basicAuth()
+		header.Set(csrfHeader, match[1])
+		assert.Equal(t, http.StatusCreated, post(url.Values{"url": {"https://header.example"}, "slug": {"header"}}, header))
+
+		// API clients that know the password
+		assert.Equal(t, http.StatusCreated, post(url.Values{"url": {"https://bearer.example"}, "slug": {"bearer"}}, http.Header{"Authorization": {"Bearer abc"}}))
+		assert.Equal(t, http.StatusCreated, post(url.Values{"url": {"https://param.example"}, "slug": {"param"}, "password": {"abc"}}, http.Header{}))
+		assert.Equal(t, http.StatusUnauthorized, post(url.Values{"url": {"https://wrong.example"}, "slug": {"wrong"}}, http.Header{"Authorization": {"Bearer wrong"}}))
+	})
+	t.Run("All forms contain the token", func(t *testing.T) {
+		app := testApp(t)
+		defer closeTestApp(t, app)
+		app.config().Password = "abc"
+		router := app.initRouter()
+		require.NoError(t, app.insertRedirect("formlink", "https://a.example", typUrl))
+		require.NoError(t, app.updateSlug(context.Background(), "https://b.example", typUrl, "formlink"))
+		require.NoError(t, app.insertRedirect("deleted", "https://c.example", typUrl))
+		require.NoError(t, app.deleteSlug("deleted"))
+
+		for _, path := range []string{"/s", "/t", "/u", "/ut", "/d", "/rename", "/h?slug=formlink", "/trash"} {
+			req := httptest.NewRequest("GET", "http://example.com"+path, nil)
+			req.SetBasicAuth("username", "abc")
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			body := w.Body.String()
+			forms := strings.Count(body, "method=post>")
+			assert.NotZero(t, forms, path)
+			for _, match := range regexp.MustCompile(`name=csrf value="([^"]+)"`).FindAllStringSubmatch(body, -1) {
+				assert.True(t, app.validCSRFToken(req, match[1]), path)
+				forms--
+			}
+			assert.Zero(t, forms, path)
+		}
+	})
+}
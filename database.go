@@ -4,70 +4,42 @@ import (
 	"context"
 	"errors"
 	"log"
-	"os"
-	"path/filepath"
-
-	"zombiezen.com/go/sqlite"
-	"zombiezen.com/go/sqlite/sqlitemigration"
-	"zombiezen.com/go/sqlite/sqlitex"
+	"slices"
 )
 
 func (a *app) openDatabase() (err error) {
-	if a.config.DBPath == "" {
+	ctx := context.Background()
+	if url := a.config().DatabaseUrl; url != "" {
+		a.db, err = openPostgres(ctx, url)
+	} else if a.config().DBPath == "" {
 		return errors.New("empty database path")
+	} else {
+		a.db, err = openSQLite(a.config().DBPath)
 	}
-	_ = os.MkdirAll(filepath.Dir(a.config.DBPath), os.ModePerm)
-	a.dbpool, err = sqlitex.NewPool(a.config.DBPath, sqlitex.PoolOptions{
-		Flags:    sqlite.OpenCreate | sqlite.OpenReadWrite | sqlite.OpenWAL,
-		PoolSize: 10,
-	})
 	if err != nil {
 		return err
 	}
 	a.shutdown.Add(func() {
-		_ = a.dbpool.Close()
+		_ = a.db.close()
 		log.Println("Closed database")
 	})
-	a.migrateDatabase()
-	// start hits aggregator
-	a.hitsChan = make(chan string, 1000)
-	a.startHitsAggregator()
-	return nil
-}
-
-func (a *app) migrateDatabase() {
 	a.write.Lock()
-	defer a.write.Unlock()
-
-	schema := sqlitemigration.Schema{
-		AppID: 0x1bd6d04a,
-		Migrations: []string{
-			`
-			drop table if exists gorp_migrations;
-			create table if not exists redirect(slug text not null primary key, url text not null, type text not null default 'url', hits integer default 0 not null);
-			insert or replace into redirect (slug, url) values ('source', 'https://git.jlel.se/jlelse/GoShort');
-			`,
-			`
-			update redirect set url = 'https://github.com/jlelse/GoShort' where slug = 'source';
-			`,
-			`
-			alter table redirect add column created integer;
-			update redirect set created = strftime('%s','now') where created is null;
-			`,
-		},
-	}
-
-	conn, err := a.dbpool.Take(context.Background())
-	if err != nil {
-		log.Fatal(err.Error())
-		return
-	}
-	defer a.dbpool.Put(conn)
-	err = sqlitemigration.Migrate(context.Background(), conn, schema)
+	err = a.db.migrate(ctx)
+	a.write.Unlock()
 	if err != nil {
-		log.Fatal(err.Error())
-		return
+		return err
 	}
+	a.cache = newLinkCache(a.config().Cache)
+	// start hits aggregator
+	a.hitsChan = make(chan click, 1000)
+	a.startHitsAggregator()
+	// start trash purger
+	a.startTrashPurger()
+	// start scheduled backups
+	a.startBackupScheduler()
+	// start rolling up clicks
+	a.startClickRollup()
+	return nil
 }
 
 const (
@@ -75,77 +47,137 @@ const (
 	typText = "text"
 )
 
+// errSlugNotFound is returned for slugs that don't exist or are in the trash
+var errSlugNotFound = errors.New("slug not found")
+
+// requestError is an error caused by the request rather than by the server,
+// handlers answer it with 400 Bad Request
+type requestError struct {
+	err error
+}
+
+func (e requestError) Error() string { return e.err.Error() }
+
+func (e requestError) Unwrap() error { return e.err }
+
 func (a *app) insertRedirect(slug string, url string, typ string) error {
 	a.write.Lock()
 	defer a.write.Unlock()
-	conn, err := a.dbpool.Take(context.Background())
-	if err != nil {
-		return err
-	}
-	defer a.dbpool.Put(conn)
-	return sqlitex.ExecuteTransient(conn, "INSERT INTO redirect (slug, url, type, created) VALUES (?, ?, ?, strftime('%s','now'))", &sqlitex.ExecOptions{
-		Args: []any{slug, url, typ},
-	})
+	err := a.db.insertLink(context.Background(), slug, url, typ)
+	a.cache.invalidate(slug)
+	return err
 }
 
+// deleteSlug moves a slug to the trash, use purgeSlug to delete it permanently
 func (a *app) deleteSlug(slug string) error {
 	a.write.Lock()
 	defer a.write.Unlock()
-	conn, err := a.dbpool.Take(context.Background())
-	if err != nil {
-		return err
-	}
-	defer a.dbpool.Put(conn)
-	return sqlitex.ExecuteTransient(conn, "DELETE FROM redirect WHERE slug = ?", &sqlitex.ExecOptions{
-		Args: []any{slug},
-	})
+	_, err := a.db.exec(context.Background(), "UPDATE redirect SET deleted = unixepoch() WHERE slug = ?", slug)
+	a.cache.invalidate(slug)
+	return err
 }
 
 func (a *app) updateSlug(ctx context.Context, url, typeStr, slug string) error {
 	a.write.Lock()
 	defer a.write.Unlock()
-	conn, err := a.dbpool.Take(ctx)
+	defer a.cache.invalidate(slug)
+	return a.db.transaction(ctx, func(tx storage) error {
+		return changeDestination(ctx, tx, url, typeStr, slug)
+	})
+}
+
+func changeDestination(ctx context.Context, tx storage, url, typeStr, slug string) error {
+	// Keep the previous destination as a revision (only if it actually changes)
+	_, err := tx.exec(ctx, "INSERT INTO revision (slug, url, type, created) SELECT slug, url, type, unixepoch() FROM redirect WHERE slug = ? AND (url != ? OR type != ?)", slug, url, typeStr)
 	if err != nil {
 		return err
 	}
-	defer a.dbpool.Put(conn)
-	return sqlitex.ExecuteTransient(conn, "UPDATE redirect SET url = ?, type = ? WHERE slug = ?", &sqlitex.ExecOptions{
-		Args: []any{url, typeStr, slug},
+	_, err = tx.exec(ctx, "UPDATE redirect SET url = ?, type = ? WHERE slug = ?", url, typeStr, slug)
+	return err
+}
+
+// updateLink changes the destination of a link and, if aliases isn't nil, replaces
+// its aliases with the parsed list. A non-empty canonical alias becomes the new
+// canonical slug. Everything is checked and changed in one transaction.
+func (a *app) updateLink(ctx context.Context, slug, url, typeStr string, aliases *string, canonical string) error {
+	a.write.Lock()
+	defer a.write.Unlock()
+	invalidate := []string{slug, canonical}
+	defer func() { a.cache.invalidate(invalidate...) }()
+	return a.db.transaction(ctx, func(tx storage) error {
+		if active, err := linkActive(ctx, tx, slug); err != nil {
+			return err
+		} else if !active {
+			return errSlugNotFound
+		}
+		current, err := aliasesOf(ctx, tx, slug)
+		if err != nil {
+			return err
+		}
+		invalidate = append(invalidate, current...)
+		newAliases := current
+		if aliases != nil {
+			if newAliases, err = a.parseAliases(ctx, tx, slug, *aliases); err != nil {
+				return err
+			}
+			invalidate = append(invalidate, newAliases...)
+		}
+		if canonical != "" && !slices.Contains(newAliases, canonical) {
+			return requestError{errors.New("the canonical slug has to be one of the aliases")}
+		}
+
+		if err := changeDestination(ctx, tx, url, typeStr, slug); err != nil {
+			return err
+		}
+		if aliases != nil {
+			if err := replaceAliases(ctx, tx, slug, newAliases); err != nil {
+				return err
+			}
+		}
+		if canonical != "" {
+			return swapCanonical(ctx, tx, slug, canonical)
+		}
+		return nil
 	})
 }
 
-func (a *app) increaseHits(slug string) {
+func (a *app) increaseHits(c click) {
 	// Try to enqueue; if buffer is full, fall back to an asynchronous DB update so we don't drop hits.
 	select {
-	case a.hitsChan <- slug:
+	case a.hitsChan <- c:
 		return
 	default:
 		// Fallback: update DB in a goroutine (avoid blocking request handling). This ensures we don't drop hits.
-		go func(s string) {
+		go func() {
 			a.write.Lock()
 			defer a.write.Unlock()
-			conn, err := a.dbpool.Take(context.Background())
-			if err != nil {
-				return
-			}
-			defer a.dbpool.Put(conn)
-			_ = sqlitex.Execute(conn, "UPDATE redirect SET hits = hits + 1 WHERE slug = ?", &sqlitex.ExecOptions{Args: []any{s}})
-		}(slug)
+			_ = a.db.recordClicks(context.Background(), []click{c})
+		}()
 	}
 }
 
-func (a *app) slugExists(slug string) (exists bool, err error) {
-	conn, err := a.dbpool.Take(context.Background())
-	if err != nil {
-		return false, err
-	}
-	defer a.dbpool.Put(conn)
-	err = sqlitex.Execute(conn, "SELECT EXISTS(SELECT 1 FROM redirect WHERE slug = ?)", &sqlitex.ExecOptions{
-		Args: []any{slug},
-		ResultFunc: func(stmt *sqlite.Stmt) error {
-			exists = stmt.ColumnInt(0) == 1
-			return nil
-		},
-	})
+// slugExists reports whether a slug is taken by a link or alias, including slugs in the trash
+func (a *app) slugExists(slug string) (bool, error) {
+	return slugTaken(context.Background(), a.db, slug)
+}
+
+func slugTaken(ctx context.Context, db storage, slug string) (exists bool, err error) {
+	err = db.query(ctx, "SELECT EXISTS(SELECT 1 FROM redirect WHERE slug = ?) OR EXISTS(SELECT 1 FROM alias WHERE slug = ?)", func(stmt resultRow) error {
+		exists = stmt.ColumnInt(0) == 1
+		return nil
+	}, slug, slug)
+	return
+}
+
+// slugActive reports whether a slug exists and is not in the trash
+func (a *app) slugActive(slug string) (bool, error) {
+	return linkActive(context.Background(), a.db, slug)
+}
+
+func linkActive(ctx context.Context, db storage, slug string) (active bool, err error) {
+	err = db.query(ctx, "SELECT EXISTS(SELECT 1 FROM redirect WHERE slug = ? AND deleted IS NULL)", func(stmt resultRow) error {
+		active = stmt.ColumnInt(0) == 1
+		return nil
+	}, slug)
 	return
 }
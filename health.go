@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+type healthCheckConfig struct {
+	// How often all destinations are checked, 0 disables the checker
+	Interval time.Duration `mapstructure:"interval"`
+	// Timeout for a single check
+	Timeout time.Duration `mapstructure:"timeout"`
+	// Number of checks running in parallel
+	Concurrency int `mapstructure:"concurrency"`
+	// Maximum number of checks per second, 0 for no limit
+	RateLimit float64 `mapstructure:"rateLimit"`
+	// URL that gets a JSON POST request when links break
+	Webhook string `mapstructure:"webhook"`
+	// Also check destinations on loopback, private and link-local addresses
+	AllowPrivate bool `mapstructure:"allowPrivate"`
+}
+
+// maxCheckRate is the highest healthCheck.rateLimit, the interval between checks has to be at least a nanosecond
+const maxCheckRate = float64(time.Second)
+
+// errPrivateAddress is the check error of destinations that resolve to a non-public address
+var errPrivateAddress = errors.New("destination resolves to a non-public address")
+
+// nonPublicPrefixes are shared and reserved ranges that the netip methods don't cover
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+}
+
+// publicAddress reports whether ip is a public unicast address
+func publicAddress(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return false
+	}
+	for _, prefix := range nonPublicPrefixes {
+		if prefix.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// refuseNonPublic is a dialer control function that refuses connections to
+// non-public addresses, so link checks can't reach services of the local network.
+// It runs after name resolution, so it covers DNS names and redirects as well.
+func refuseNonPublic(_, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	if !publicAddress(addrPort.Addr()) {
+		return errPrivateAddress
+	}
+	return nil
+}
+
+// checkClient returns the HTTP client for link checks, which only connects to
+// public addresses unless healthCheck.allowPrivate is set
+func checkClient(cfg healthCheckConfig, timeout time.Duration) *http.Client {
+	if cfg.AllowPrivate {
+		return &http.Client{Timeout: timeout}
+	}
+	dialer := &net.Dialer{Timeout: timeout, Control: refuseNonPublic}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// A proxy would connect to the destination instead of the dialer
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Timeout: timeout, Transport: transport}
+}
+
+type checkResult struct {
+	Status  int
+	Latency time.Duration
+	Error   string
+}
+
+func (c *checkResult) broken() bool {
+	return c.Error != "" || c.Status >= 400
+}
+
+type brokenLink struct {
+	Slug   string `json:"slug"`
+	URL    string `json:"url"`
+	Short  string `json:"short"`
+	Status int    `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// startHealthChecker starts a background worker that periodically checks all link destinations.
+func (a *app) startHealthChecker() {
+	if a.config().HealthCheck.Interval <= 0 {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Go(func() {
+		ticker := time.NewTicker(a.config().HealthCheck.Interval)
+		defer ticker.Stop()
+		for {
+			if err := a.checkLinks(ctx); err != nil && ctx.Err() == nil {
+				log.Println("Failed to check links:", err.Error())
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	})
+	a.shutdown.Add(func() {
+		cancel()
+		wg.Wait()
+	})
+}
+
+// checkLinks checks the destinations of all active URL links once and
+// notifies the webhook about links that weren't broken before.
+func (a *app) checkLinks(ctx context.Context) error {
+	cfg := a.config().HealthCheck
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	concurrency := max(cfg.Concurrency, 1)
+
+	links, err := a.db.listLinks(ctx, orderCreated, false)
+	if err != nil {
+		return err
+	}
+
+	client := checkClient(cfg, timeout)
+
+	var limiter <-chan time.Time
+	if cfg.RateLimit > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / cfg.RateLimit))
+		defer ticker.Stop()
+		limiter = ticker.C
+	}
+
+	jobs := make(chan *storedLink)
+	var newlyBroken []*brokenLink
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for range concurrency {
+		wg.Go(func() {
+			for l := range jobs {
+				res := checkLink(ctx, client, l.url)
+				if ctx.Err() != nil {
+					// Don't store results of aborted checks
+					continue
+				}
+				if err := a.saveCheckResult(l.slug, res); err != nil {
+					log.Println("Failed to save check result:", err.Error())
+				}
+				if res.broken() && !l.check.broken() {
+					short, _ := url.JoinPath(a.config().ShortUrl, l.slug)
+					mu.Lock()
+					newlyBroken = append(newlyBroken, &brokenLink{Slug: l.slug, URL: l.url, Short: short, Status: res.Status, Error: res.Error})
+					mu.Unlock()
+				}
+			}
+		})
+	}
+feed:
+	for _, l := range links {
+		if l.typ != typUrl {
+			continue
+		}
+		if limiter != nil {
+			select {
+			case <-limiter:
+			case <-ctx.Done():
+				break feed
+			}
+		}
+		select {
+		case jobs <- l:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if len(newlyBroken) > 0 && cfg.Webhook != "" {
+		// The webhook is configured by the admin and may well be on the local network
+		return a.notifyBrokenLinks(ctx, &http.Client{Timeout: timeout}, newlyBroken)
+	}
+	return nil
+}
+
+// checkLink requests a destination with HEAD, falling back to GET for servers that don't support HEAD.
+func checkLink(ctx context.Context, client *http.Client, destination string) *checkResult {
+	res := &checkResult{}
+	start := time.Now()
+	for _, method := range []string{http.MethodHead, http.MethodGet} {
+		req, err := http.NewRequestWithContext(ctx, method, destination, nil)
+		if err != nil {
+			res.Error = err.Error()
+			return res
+		}
+		req.Header.Set("User-Agent", "GoShort link checker")
+		resp, err := client.Do(req)
+		if err != nil {
+			res.Error = err.Error()
+			res.Latency = time.Since(start)
+			return res
+		}
+		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+		_ = resp.Body.Close()
+		res.Status = resp.StatusCode
+		res.Latency = time.Since(start)
+		if resp.StatusCode != http.StatusMethodNotAllowed && resp.StatusCode != http.StatusNotImplemented {
+			break
+		}
+		start = time.Now()
+	}
+	return res
+}
+
+func (a *app) saveCheckResult(slug string, res *checkResult) error {
+	a.write.Lock()
+	defer a.write.Unlock()
+	return a.db.saveCheckResult(context.Background(), slug, res)
+}
+
+func (a *app) notifyBrokenLinks(ctx context.Context, client *http.Client, links []*brokenLink) error {
+	payload, err := json.Marshal(map[string]any{
+		"text":  fmt.Sprintf("GoShort found %d broken links", len(links)),
+		"links": links,
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.config().HealthCheck.Webhook, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (a *app) brokenHandler(w http.ResponseWriter, r *http.Request) {
+	type row struct {
+		Slug    string
+		URL     string
+		Status  string
+		Latency string
+		Checked string
+	}
+	var list []row
+
+	links, err := a.db.brokenLinks(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, l := range links {
+		list = append(list, row{
+			Slug:    l.slug,
+			URL:     l.url,
+			Status:  checkStatusText(l.check.Status, l.check.Error),
+			Latency: strconv.FormatInt(l.check.Latency.Milliseconds(), 10) + " ms",
+			Checked: l.checked.UTC().Format(time.DateTime),
+		})
+	}
+
+	err = brokenTemplate.Execute(w, &templateData{Style: template.CSS(styleCSS), Data: map[string]any{
+		"List": list,
+	}})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// checkStatusText returns a human readable description of a check result
+func checkStatusText(status int, checkError string) string {
+	if checkError != "" {
+		return checkError
+	}
+	return strconv.Itoa(status) + " " + http.StatusText(status)
+}
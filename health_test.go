@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealthChecker(t *testing.T) {
+	t.Run("Check destinations and notify about broken links", func(t *testing.T) {
+		destinations := http.NewServeMux()
+		destinations.HandleFunc("/ok", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		})
+		destinations.HandleFunc("/gone", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNotFound)
+		})
+		destinations.HandleFunc("/nohead", func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodHead {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		})
+		var notifications []map[string]any
+		var mu sync.Mutex
+		destinations.HandleFunc("/webhook", func(w http.ResponseWriter, r *http.Request) {
+			var payload map[string]any
+			_ = json.NewDecoder(r.Body).Decode(&payload)
+			mu.Lock()
+			notifications = append(notifications, payload)
+			mu.Unlock()
+		})
+		srv := httptest.NewServer(destinations)
+		defer srv.Close()
+
+		app := testApp(t)
+		defer closeTestApp(t, app)
+		app.config().Password = "abc"
+		app.config().ShortUrl = "https://short.example.com"
+		app.config().HealthCheck = healthCheckConfig{
+			Concurrency:  2,
+			RateLimit:    100,
+			Webhook:      srv.URL + "/webhook",
+			AllowPrivate: true,
+		}
+
+		require.NoError(t, app.deleteSlug("source"))
+		require.NoError(t, app.insertRedirect("ok", srv.URL+"/ok", typUrl))
+		require.NoError(t, app.insertRedirect("gone", srv.URL+"/gone", typUrl))
+		require.NoError(t, app.insertRedirect("nohead", srv.URL+"/nohead", typUrl))
+		require.NoError(t, app.insertRedirect("text", "Not a URL", typText))
+
+		require.NoError(t, app.checkLinks(context.Background()))
+
+		router := app.initRouter()
+		get := func(path string) string {
+			req := httptest.NewRequest("GET", "http://example.com"+path, nil)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			resp := w.Result()
+			body, _ := io.ReadAll(resp.Body)
+			_ = resp.Body.Close()
+			return string(body)
+		}
+
+		report := get("/broken?password=abc")
+		assert.Contains(t, report, "title=\"gone\"")
+		assert.Contains(t, report, "404 Not Found")
+		assert.NotContains(t, report, "title=\"ok\"")
+		assert.NotContains(t, report, "title=\"nohead\"")
+		assert.NotContains(t, report, "title=\"text\"")
+
+		list := get("/l?password=abc")
+		assert.Contains(t, list, "title=\"404 Not Found\">broken</span> "+srv.URL+"/gone")
+		assert.NotContains(t, list, "broken</span> "+srv.URL+"/ok")
+
+		mu.Lock()
+		require.Len(t, notifications, 1)
+		links := notifications[0]["links"].([]any)
+		require.Len(t, links, 1)
+		assert.Equal(t, "gone", links[0].(map[string]any)["slug"])
+		assert.Equal(t, "https://short.example.com/gone", links[0].(map[string]any)["short"])
+		mu.Unlock()
+
+		// links that are still broken don't trigger another notification
+		require.NoError(t, app.checkLinks(context.Background()))
+		mu.Lock()
+		assert.Len(t, notifications, 1)
+		mu.Unlock()
+	})
+	t.Run("Non-public destinations aren't checked by default", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t.Error("the local server shouldn't be requested")
+		}))
+		defer srv.Close()
+
+		app := testApp(t)
+		defer closeTestApp(t, app)
+		app.config().HealthCheck = healthCheckConfig{Concurrency: 1}
+
+		require.NoError(t, app.deleteSlug("source"))
+		require.NoError(t, app.insertRedirect("local", srv.URL, typUrl))
+		require.NoError(t, app.checkLinks(context.Background()))
+
+		var checkError string
+		require.NoError(t, app.db.query(context.Background(), "SELECT check_error FROM redirect WHERE slug = ?", func(stmt resultRow) error {
+			checkError = stmt.ColumnText(0)
+			return nil
+		}, "local"))
+		assert.Contains(t, checkError, errPrivateAddress.Error())
+
+		for addr, public := range map[string]bool{
+			"93.184.215.14": true, "2606:2800:21f:cb07:6820:80da:af6b:8b2c": true,
+			"127.0.0.1": false, "::1": false, "10.1.2.3": false, "192.168.0.1": false, "169.254.169.254": false,
+			"fe80::1": false, "fd00::1": false, "0.0.0.0": false, "100.64.0.1": false, "::ffff:127.0.0.1": false, "224.0.0.1": false,
+		} {
+			assert.Equal(t, public, publicAddress(netip.MustParseAddr(addr)), addr)
+		}
+	})
+}
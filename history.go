@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"html/template"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type revision struct {
+	ID      int64
+	URL     string
+	Type    string
+	Created int64
+}
+
+// getRevisions returns all previous destinations of a slug, newest first.
+func (a *app) getRevisions(ctx context.Context, slug string) (revisions []*revision, err error) {
+	err = a.db.query(ctx, "SELECT id, url, type, created FROM revision WHERE slug = ? ORDER BY created DESC, id DESC", func(stmt resultRow) error {
+		revisions = append(revisions, &revision{
+			ID:      stmt.ColumnInt64(0),
+			URL:     stmt.ColumnText(1),
+			Type:    stmt.ColumnText(2),
+			Created: stmt.ColumnInt64(3),
+		})
+		return nil
+	}, slug)
+	return
+}
+
+// getRevision returns a single revision of a slug or nil if it doesn't exist.
+func (a *app) getRevision(ctx context.Context, slug string, id int64) (rev *revision, err error) {
+	err = a.db.query(ctx, "SELECT id, url, type, created FROM revision WHERE slug = ? AND id = ?", func(stmt resultRow) error {
+		rev = &revision{
+			ID:      stmt.ColumnInt64(0),
+			URL:     stmt.ColumnText(1),
+			Type:    stmt.ColumnText(2),
+			Created: stmt.ColumnInt64(3),
+		}
+		return nil
+	}, slug, id)
+	return
+}
+
+func (a *app) historyHandler(w http.ResponseWriter, r *http.Request) {
+	slug := a.requestSlug(r)
+	if slug == "" {
+		http.Error(w, "Specify the slug to show the history for", http.StatusBadRequest)
+		return
+	}
+
+	var currentURL, currentType string
+	err := a.db.query(r.Context(), "SELECT url, type FROM redirect WHERE slug = ? AND deleted IS NULL", func(stmt resultRow) error {
+		currentURL = stmt.ColumnText(0)
+		currentType = stmt.ColumnText(1)
+		return nil
+	}, slug)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if currentURL == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	revisions, err := a.getRevisions(r.Context(), slug)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	type row struct {
+		ID   int64
+		URL  string
+		Type string
+		Time string
+	}
+	rows := make([]row, 0, len(revisions))
+	for _, rev := range revisions {
+		rows = append(rows, row{
+			ID:   rev.ID,
+			URL:  rev.URL,
+			Type: rev.Type,
+			Time: time.Unix(rev.Created, 0).UTC().Format(time.DateTime),
+		})
+	}
+
+	err = historyTemplate.Execute(w, &templateData{Style: template.CSS(styleCSS), CSRF: a.csrfToken(r), Data: map[string]any{
+		"Slug":      slug,
+		"URL":       currentURL,
+		"Type":      currentType,
+		"Revisions": rows,
+	}})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (a *app) rollbackHandler(w http.ResponseWriter, r *http.Request) {
+	slug := a.requestSlug(r)
+	if slug == "" {
+		http.Error(w, "Specify the slug to roll back", http.StatusBadRequest)
+		return
+	}
+
+	id, err := strconv.ParseInt(r.FormValue("revision"), 10, 64)
+	if err != nil {
+		http.Error(w, "Specify the revision to restore", http.StatusBadRequest)
+		return
+	}
+
+	if e, err := a.slugActive(slug); err != nil || !e {
+		http.NotFound(w, r)
+		return
+	}
+
+	rev, err := a.getRevision(r.Context(), slug, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if rev == nil {
+		http.NotFound(w, r)
+		return
+	}
+	// The policy might have changed since this revision was stored
+	if err := a.checkLink(rev.Type, rev.URL); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Restore through the normal update path, so the replaced destination becomes a revision too
+	if err := a.updateSlug(r.Context(), rev.URL, rev.Type, slug); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	_, _ = io.WriteString(w, "Slug rolled back")
+}
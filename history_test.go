@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRevisionHistory(t *testing.T) {
+	t.Run("Updates store revisions and rollback restores them", func(t *testing.T) {
+		app := testApp(t)
+		defer closeTestApp(t, app)
+		app.config().Password = "abc"
+
+		router := app.initRouter()
+
+		require.NoError(t, app.insertRedirect("hist", "https://one.example", typUrl))
+		require.NoError(t, app.updateSlug(context.Background(), "https://two.example", typUrl, "hist"))
+		// updating to the same destination doesn't create a revision
+		require.NoError(t, app.updateSlug(context.Background(), "https://two.example", typUrl, "hist"))
+
+		revisions, err := app.getRevisions(context.Background(), "hist")
+		require.NoError(t, err)
+		require.Len(t, revisions, 1)
+		assert.Equal(t, "https://one.example", revisions[0].URL)
+		assert.Equal(t, typUrl, revisions[0].Type)
+
+		// history page lists the previous destination
+		req := httptest.NewRequest("GET", "http://example.com/h?password=abc&slug=hist", nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		resp := w.Result()
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Contains(t, string(body), "https://one.example")
+		assert.Contains(t, string(body), "https://two.example")
+
+		// unknown slug
+		req = httptest.NewRequest("GET", "http://example.com/h?password=abc&slug=unknown", nil)
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusNotFound, w.Result().StatusCode)
+
+		// rollback
+		form := url.Values{"password": {"abc"}, "slug": {"hist"}, "revision": {strconv.FormatInt(revisions[0].ID, 10)}}
+		req = httptest.NewRequest("POST", "http://example.com/r", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusAccepted, w.Result().StatusCode)
+
+		req = httptest.NewRequest("GET", "http://example.com/hist", nil)
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, "https://one.example", w.Result().Header.Get("Location"))
+
+		// the rolled back destination is kept as a revision as well
+		revisions, err = app.getRevisions(context.Background(), "hist")
+		require.NoError(t, err)
+		require.Len(t, revisions, 2)
+		assert.Equal(t, "https://two.example", revisions[0].URL)
+
+		// rollback to a revision of another slug isn't possible
+		form = url.Values{"password": {"abc"}, "slug": {"source"}, "revision": {strconv.FormatInt(revisions[0].ID, 10)}}
+		req = httptest.NewRequest("POST", "http://example.com/r", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusNotFound, w.Result().StatusCode)
+
+		// deleting a slug permanently removes its history
+		require.NoError(t, app.deleteSlug("hist"))
+		require.NoError(t, app.purgeSlug("hist"))
+		revisions, err = app.getRevisions(context.Background(), "hist")
+		require.NoError(t, err)
+		assert.Empty(t, revisions)
+	})
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html"
+	"golang.org/x/oauth2"
+)
+
+type indieAuthConfig struct {
+	// Profile URL of the admin like https://example.com/, IndieAuth is disabled if empty
+	Me string `mapstructure:"me"`
+}
+
+const indieAuthCookie = "goshort_indieauth"
+
+var indieAuthClient = &http.Client{Timeout: 10 * time.Second}
+
+// indieAuthEndpoints are the endpoints of the IndieAuth server of the profile URL
+type indieAuthEndpoints struct {
+	Issuer        string `json:"issuer"`
+	Authorization string `json:"authorization_endpoint"`
+	Token         string `json:"token_endpoint"`
+}
+
+// indieAuthFlow is the state of a login between the redirect to the
+// authorization endpoint and the callback, it is kept in a cookie
+type indieAuthFlow struct {
+	State    string `json:"state"`
+	Verifier string `json:"verifier"`
+	Next     string `json:"next"`
+}
+
+var (
+	errIndieAuthNotAllowed = errors.New("the profile URL is not allowed to log in")
+	errInvalidAccessToken  = errors.New("the access token is invalid")
+)
+
+// canonicalProfileURL normalizes a profile URL like IndieAuth does, example.com becomes https://example.com/
+func canonicalProfileURL(me string) (string, error) {
+	if !strings.Contains(me, "://") {
+		me = "https://" + me
+	}
+	u, err := url.Parse(me)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" || u.User != nil || u.Fragment != "" {
+		return "", fmt.Errorf("%q is not a valid profile URL", me)
+	}
+	u.Host = strings.ToLower(u.Host)
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	return u.String(), nil
+}
+
+func validProfileURL(me string) bool {
+	_, err := canonicalProfileURL(me)
+	return err == nil
+}
+
+// profileURLMatches reports whether me is the configured profile URL
+func (a *app) profileURLMatches(me string) bool {
+	configured, err := canonicalProfileURL(a.config().IndieAuth.Me)
+	if err != nil {
+		return false
+	}
+	me, err = canonicalProfileURL(me)
+	return err == nil && me == configured
+}
+
+func (a *app) indieAuthClientID() string {
+	return a.config().ShortUrl + "/"
+}
+
+func (a *app) indieAuthRedirectURL() string {
+	redirectURL, _ := url.JoinPath(a.config().ShortUrl, "indieauth", "callback")
+	return redirectURL
+}
+
+// indieAuthEndpoints returns the endpoints of the profile URL, which are discovered on first use
+func (a *app) indieAuthEndpoints(ctx context.Context) (indieAuthEndpoints, error) {
+	a.indieAuthMu.Lock()
+	defer a.indieAuthMu.Unlock()
+	if a.indieAuth != nil {
+		return *a.indieAuth, nil
+	}
+	me, err := canonicalProfileURL(a.config().IndieAuth.Me)
+	if err != nil {
+		return indieAuthEndpoints{}, err
+	}
+	rels, err := discoverRels(ctx, me)
+	if err != nil {
+		return indieAuthEndpoints{}, err
+	}
+	var endpoints indieAuthEndpoints
+	if metadata := rels["indieauth-metadata"]; metadata != "" {
+		if err := getJSON(ctx, metadata, "", &endpoints); err != nil {
+			return indieAuthEndpoints{}, err
+		}
+	} else {
+		endpoints.Authorization, endpoints.Token = rels["authorization_endpoint"], rels["token_endpoint"]
+	}
+	if endpoints.Authorization == "" {
+		return indieAuthEndpoints{}, fmt.Errorf("no IndieAuth authorization endpoint found for %s", me)
+	}
+	a.indieAuth = &endpoints
+	return endpoints, nil
+}
+
+var (
+	linkHeaderPattern = regexp.MustCompile(`<([^>]*)>([^,<]*)`)
+	linkRelPattern    = regexp.MustCompile(`rel="?([^";]*)"?`)
+)
+
+// discoverRels fetches a page and returns the first URL of every rel in the
+// Link headers and the link and a elements of the HTML
+func discoverRels(ctx context.Context, pageURL string) (map[string]string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, pageURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/html")
+	res, err := indieAuthClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = res.Body.Close() }()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned status %d", pageURL, res.StatusCode)
+	}
+	rels := map[string]string{}
+	add := func(rel, href string) {
+		target, err := res.Request.URL.Parse(strings.TrimSpace(href))
+		if err != nil {
+			return
+		}
+		for r := range strings.FieldsSeq(rel) {
+			if _, ok := rels[r]; !ok {
+				rels[r] = target.String()
+			}
+		}
+	}
+	for _, header := range res.Header.Values("Link") {
+		for _, link := range linkHeaderPattern.FindAllStringSubmatch(header, -1) {
+			if rel := linkRelPattern.FindStringSubmatch(link[2]); rel != nil {
+				add(rel[1], link[1])
+			}
+		}
+	}
+	if mediaType, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type")); mediaType != "text/html" {
+		return rels, nil
+	}
+	tokenizer := html.NewTokenizer(io.LimitReader(res.Body, 1<<20))
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			return rels, nil
+		case html.StartTagToken, html.SelfClosingTagToken:
+			token := tokenizer.Token()
+			if token.Data != "link" && token.Data != "a" {
+				continue
+			}
+			var rel, href string
+			for _, attr := range token.Attr {
+				switch attr.Key {
+				case "rel":
+					rel = attr.Val
+				case "href":
+					href = attr.Val
+				}
+			}
+			if rel != "" && href != "" {
+				add(rel, href)
+			}
+		}
+	}
+}
+
+// getJSON decodes the JSON response of a GET request, authenticated with the token if not empty
+func getJSON(ctx context.Context, endpoint, token string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	res, err := indieAuthClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = res.Body.Close() }()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned status %d", endpoint, res.StatusCode)
+	}
+	return json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(v)
+}
+
+// indieAuthLoginHandler redirects to the authorization endpoint of the profile URL
+func (a *app) indieAuthLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if a.config().IndieAuth.Me == "" {
+		http.NotFound(w, r)
+		return
+	}
+	endpoints, err := a.indieAuthEndpoints(r.Context())
+	if err != nil {
+		log.Println("Failed to discover the IndieAuth endpoints:", err.Error())
+		http.Error(w, "The IndieAuth server is not available", http.StatusBadGateway)
+		return
+	}
+	flow := indieAuthFlow{State: rand.Text(), Verifier: oauth2.GenerateVerifier(), Next: localRedirectTarget(r.FormValue("next"))}
+	value, _ := json.Marshal(flow)
+	http.SetCookie(w, &http.Cookie{
+		Name:     indieAuthCookie,
+		Value:    base64.RawURLEncoding.EncodeToString(value),
+		Path:     "/indieauth/",
+		MaxAge:   int((10 * time.Minute).Seconds()),
+		Secure:   r.TLS != nil || strings.HasPrefix(a.config().ShortUrl, "https://"),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	me, _ := canonicalProfileURL(a.config().IndieAuth.Me)
+	authorizeURL, _ := url.Parse(endpoints.Authorization)
+	query := authorizeURL.Query()
+	query.Set("response_type", "code")
+	query.Set("client_id", a.indieAuthClientID())
+	query.Set("redirect_uri", a.indieAuthRedirectURL())
+	query.Set("state", flow.State)
+	query.Set("code_challenge", oauth2.S256ChallengeFromVerifier(flow.Verifier))
+	query.Set("code_challenge_method", "S256")
+	query.Set("me", me)
+	authorizeURL.RawQuery = query.Encode()
+	http.Redirect(w, r, authorizeURL.String(), http.StatusFound)
+}
+
+// indieAuthCallbackHandler redeems the authorization code and creates an admin session
+func (a *app) indieAuthCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	if a.config().IndieAuth.Me == "" {
+		http.NotFound(w, r)
+		return
+	}
+	var flow indieAuthFlow
+	if cookie, err := r.Cookie(indieAuthCookie); err == nil {
+		value, _ := base64.RawURLEncoding.DecodeString(cookie.Value)
+		_ = json.Unmarshal(value, &flow)
+	}
+	http.SetCookie(w, &http.Cookie{Name: indieAuthCookie, Path: "/indieauth/", MaxAge: -1})
+	if flow.State == "" || r.FormValue("state") != flow.State {
+		a.renderLogin(w, http.StatusBadRequest, "", "The login expired, try again")
+		return
+	}
+	if e := r.FormValue("error"); e != "" {
+		a.renderLogin(w, http.StatusUnauthorized, flow.Next, "Login failed: "+strings.TrimSpace(e+" "+r.FormValue("error_description")))
+		return
+	}
+	me, err := a.indieAuthRedeem(r.Context(), r.FormValue("code"), r.FormValue("iss"), flow)
+	if err != nil {
+		log.Println("IndieAuth login failed:", err.Error())
+		status := http.StatusUnauthorized
+		if errors.Is(err, errIndieAuthNotAllowed) {
+			status = http.StatusForbidden
+		}
+		a.renderLogin(w, status, flow.Next, "Login failed: "+err.Error())
+		return
+	}
+	id, expires, err := a.createSession(r.Context(), user{name: me, role: roleAdmin})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	a.setSessionCookie(w, r, id, expires)
+	http.Redirect(w, r, flow.Next, http.StatusSeeOther)
+}
+
+// indieAuthRedeem redeems the authorization code at the authorization endpoint
+// and returns the profile URL, which has to be the configured one
+func (a *app) indieAuthRedeem(ctx context.Context, code, issuer string, flow indieAuthFlow) (string, error) {
+	endpoints, err := a.indieAuthEndpoints(ctx)
+	if err != nil {
+		return "", err
+	}
+	if endpoints.Issuer != "" && issuer != endpoints.Issuer {
+		return "", errors.New("the response has a wrong issuer")
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"client_id":     {a.indieAuthClientID()},
+		"redirect_uri":  {a.indieAuthRedirectURL()},
+		"code_verifier": {flow.Verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoints.Authorization, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	res, err := indieAuthClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = res.Body.Close() }()
+	var body struct {
+		Me               string `json:"me"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	_ = json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(&body)
+	if res.StatusCode != http.StatusOK || body.Me == "" {
+		return "", fmt.Errorf("the authorization endpoint rejected the code: %s", strings.TrimSpace(body.Error+" "+body.ErrorDescription))
+	}
+	if !a.profileURLMatches(body.Me) {
+		return "", errIndieAuthNotAllowed
+	}
+	return canonicalProfileURL(body.Me)
+}
+
+// verifyAccessToken verifies a token issued by the IndieAuth server of the
+// profile URL at its token endpoint and returns the scopes of the token
+func (a *app) verifyAccessToken(ctx context.Context, token string) (me string, scopes []string, err error) {
+	if a.config().IndieAuth.Me == "" {
+		return "", nil, errInvalidAccessToken
+	}
+	endpoints, err := a.indieAuthEndpoints(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+	if endpoints.Token == "" {
+		return "", nil, errors.New("no IndieAuth token endpoint found")
+	}
+	var body struct {
+		Me    string `json:"me"`
+		Scope string `json:"scope"`
+	}
+	if err := getJSON(ctx, endpoints.Token, token, &body); err != nil || !a.profileURLMatches(body.Me) {
+		return "", nil, errInvalidAccessToken
+	}
+	me, _ = canonicalProfileURL(body.Me)
+	return me, strings.Fields(body.Scope), nil
+}
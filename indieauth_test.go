@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mockIndieAuthServer is a personal site with its own IndieAuth server that
+// logs in every authorization request with the configured profile URL
+type mockIndieAuthServer struct {
+	*httptest.Server
+
+	mu    sync.Mutex
+	me    string
+	codes map[string]url.Values
+}
+
+func newMockIndieAuthServer(t *testing.T) *mockIndieAuthServer {
+	s := &mockIndieAuthServer{codes: map[string]url.Values{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Link", `</token>; rel="token_endpoint"`)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write([]byte(`<!doctype html><link rel="authorization_endpoint" href="/auth"><a rel=me href="https://social.example/@me">me</a>`))
+	})
+	mux.HandleFunc("GET /auth", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("response_type") != "code" || q.Get("client_id") != "https://short.example/" || q.Get("code_challenge_method") != "S256" || q.Get("me") != s.URL+"/" {
+			http.Error(w, "invalid authorization request", http.StatusBadRequest)
+			return
+		}
+		code := rand.Text()
+		s.mu.Lock()
+		s.codes[code] = q
+		s.mu.Unlock()
+		http.Redirect(w, r, q.Get("redirect_uri")+"?"+url.Values{"code": {code}, "state": {q.Get("state")}}.Encode(), http.StatusFound)
+	})
+	mux.HandleFunc("POST /auth", func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		auth, ok := s.codes[r.PostFormValue("code")]
+		delete(s.codes, r.PostFormValue("code"))
+		me := s.me
+		s.mu.Unlock()
+		challenge := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+		w.Header().Set("Content-Type", "application/json")
+		if !ok || r.PostFormValue("grant_type") != "authorization_code" || auth.Get("client_id") != r.PostFormValue("client_id") ||
+			auth.Get("redirect_uri") != r.PostFormValue("redirect_uri") || base64.RawURLEncoding.EncodeToString(challenge[:]) != auth.Get("code_challenge") {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{"me": me})
+	})
+	mux.HandleFunc("GET /token", func(w http.ResponseWriter, r *http.Request) {
+		var scope string
+		switch r.Header.Get("Authorization") {
+		case "Bearer create-token":
+			scope = "create update"
+		case "Bearer read-token":
+			scope = "read"
+		default:
+			http.Error(w, `{"error":"invalid_token"}`, http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]string{"me": s.URL + "/", "client_id": "https://client.example/", "scope": scope})
+	})
+	s.Server = httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return s
+}
+
+// indieAuthTestApp returns an app that only allows the profile URL of the mock server to log in
+func indieAuthTestApp(t *testing.T, s *mockIndieAuthServer) *app {
+	app := testApp(t)
+	app.config().Password = ""
+	app.config().ShortUrl = "https://short.example"
+	app.config().DefaultUrl = "https://default.example"
+	app.config().IndieAuth.Me = strings.ToUpper(s.URL[:4]) + s.URL[4:]
+	require.NoError(t, validateConfig(app.config()))
+	return app
+}
+
+func TestIndieAuth(t *testing.T) {
+	server := newMockIndieAuthServer(t)
+	app := indieAuthTestApp(t, server)
+	defer closeTestApp(t, app)
+	router := app.initRouter()
+	noRedirects := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+
+	get := func(path string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://example.com"+path, nil)
+		req.Header.Set("Accept", "text/html")
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	// login goes through the flow and returns the response of the callback
+	login := func(me string) *httptest.ResponseRecorder {
+		server.mu.Lock()
+		server.me = me
+		server.mu.Unlock()
+
+		w := get("/indieauth/login?next=%2Fl")
+		require.Equal(t, http.StatusFound, w.Code, w.Body.String())
+		require.Len(t, w.Result().Cookies(), 1)
+		flowCookie := w.Result().Cookies()[0]
+		authorize := w.Header().Get("Location")
+		require.True(t, strings.HasPrefix(authorize, server.URL+"/auth?"), authorize)
+
+		res, err := noRedirects.Get(authorize)
+		require.NoError(t, err)
+		_ = res.Body.Close()
+		require.Equal(t, http.StatusFound, res.StatusCode)
+		callback, err := url.Parse(res.Header.Get("Location"))
+		require.NoError(t, err)
+		require.Equal(t, "https://short.example/indieauth/callback", callback.Scheme+"://"+callback.Host+callback.Path)
+		return get("/indieauth/callback?"+callback.RawQuery, flowCookie)
+	}
+
+	t.Run("The login page offers IndieAuth", func(t *testing.T) {
+		w := get("/login?next=%2Fl")
+		assert.Contains(t, w.Body.String(), `href="/indieauth/login?next=%2fl">Log in with IndieAuth</a>`)
+		assert.NotContains(t, w.Body.String(), "name=password")
+	})
+	t.Run("The profile URL logs in as admin", func(t *testing.T) {
+		w := login(server.URL)
+		require.Equal(t, http.StatusSeeOther, w.Code, w.Body.String())
+		assert.Equal(t, "/l", w.Header().Get("Location"))
+		var cookie *http.Cookie
+		for _, c := range w.Result().Cookies() {
+			if c.Name == sessionCookie {
+				cookie = c
+			}
+		}
+		require.NotNil(t, cookie)
+		assert.Equal(t, http.StatusOK, get("/l", cookie).Code)
+		assert.Equal(t, http.StatusOK, get("/metrics", cookie).Code)
+
+		var username, role string
+		require.NoError(t, app.db.query(context.Background(), "SELECT username, role FROM session WHERE id = ?", func(stmt resultRow) error {
+			username, role = stmt.ColumnText(0), stmt.ColumnText(1)
+			return nil
+		}, hashSessionID(cookie.Value)))
+		assert.Equal(t, server.URL+"/", username)
+		assert.Equal(t, roleAdmin, role)
+	})
+	t.Run("Other profile URLs are rejected", func(t *testing.T) {
+		w := login("https://someone.example/")
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		assert.Contains(t, w.Body.String(), "not allowed")
+		for _, c := range w.Result().Cookies() {
+			assert.NotEqual(t, sessionCookie, c.Name)
+		}
+	})
+	t.Run("Callbacks of other logins are rejected", func(t *testing.T) {
+		assert.Equal(t, http.StatusBadRequest, get("/indieauth/callback?code=abc&state=def").Code)
+	})
+	t.Run("Profile URLs", func(t *testing.T) {
+		for in, want := range map[string]string{
+			"example.com":                "https://example.com/",
+			"https://Example.com":        "https://example.com/",
+			"http://example.com/~me/":    "http://example.com/~me/",
+			"https://example.com/?a=b":   "https://example.com/?a=b",
+			"ftp://example.com/":         "",
+			"https://user@example.com/":  "",
+			"https://example.com/#about": "",
+		} {
+			got, err := canonicalProfileURL(in)
+			if want == "" {
+				assert.Error(t, err, in)
+			} else {
+				assert.Equal(t, want, got, in)
+			}
+		}
+		cfg := &config{ShortUrl: "https://short.example", DefaultUrl: "https://default.example"}
+		assert.ErrorContains(t, validateConfig(cfg), "no password")
+		cfg.IndieAuth.Me = "ftp://example.com/"
+		assert.ErrorContains(t, validateConfig(cfg), "indieAuth.me")
+		cfg.IndieAuth.Me = "example.com"
+		assert.NoError(t, validateConfig(cfg))
+	})
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// First file descriptor passed by systemd socket activation
+const listenFdsStart = 3
+
+// listeners returns the listeners to serve on. Sockets passed by systemd
+// socket activation take precedence over the Unix socket and TCP settings.
+func (a *app) listeners() ([]net.Listener, error) {
+	if ls, err := systemdListeners(); err != nil || len(ls) > 0 {
+		return ls, err
+	}
+	cfg := a.config()
+	if cfg.Socket != "" {
+		l, err := listenUnix(cfg.Socket, cfg.SocketMode)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{l}, nil
+	}
+	l, err := net.Listen("tcp", net.JoinHostPort(cfg.Address, strconv.Itoa(cfg.Port)))
+	if err != nil {
+		return nil, err
+	}
+	return []net.Listener{l}, nil
+}
+
+// systemdListeners returns the sockets passed by systemd (see sd_listen_fds)
+func systemdListeners() ([]net.Listener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return nil, nil
+	}
+	// The variables are only meant for this process, not for child processes
+	_ = os.Unsetenv("LISTEN_PID")
+	_ = os.Unsetenv("LISTEN_FDS")
+	_ = os.Unsetenv("LISTEN_FDNAMES")
+	var listeners []net.Listener
+	for fd := listenFdsStart; fd < listenFdsStart+count; fd++ {
+		f := os.NewFile(uintptr(fd), "listen-fd-"+strconv.Itoa(fd))
+		l, err := net.FileListener(f)
+		// FileListener duplicates the file descriptor
+		_ = f.Close()
+		if err != nil {
+			for _, l := range listeners {
+				_ = l.Close()
+			}
+			return nil, fmt.Errorf("systemd socket %d: %w", fd, err)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// listenUnix listens on a Unix domain socket, replacing a stale socket file,
+// and sets the permissions of the socket file (like 0660) if configured.
+func listenUnix(path, mode string) (net.Listener, error) {
+	var perm fs.FileMode
+	if mode != "" {
+		m, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil || m > 0o777 {
+			return nil, fmt.Errorf("invalid socket mode %q", mode)
+		}
+		perm = fs.FileMode(m)
+	}
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode().Type() != fs.ModeSocket {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		// Left over from a previous run that didn't shut down cleanly
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	if mode != "" {
+		// Create the socket file without the permissions that aren't configured,
+		// so it's never accessible with the permissions of the default umask. The
+		// umask is process-wide, files created meanwhile get fewer permissions at worst.
+		old := syscall.Umask(0o777 &^ int(perm))
+		defer syscall.Umask(old)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if mode != "" {
+		// The umask can only take away permissions, set them exactly
+		if err := os.Chmod(path, perm); err != nil {
+			_ = l.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
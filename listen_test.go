@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListeners(t *testing.T) {
+	t.Run("Unix socket with permissions", func(t *testing.T) {
+		app := testApp(t)
+		defer closeTestApp(t, app)
+		// Socket paths are limited to about 100 characters, so don't use the long test directory
+		dir, err := os.MkdirTemp("", "goshort")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+		socket := filepath.Join(dir, "goshort.sock")
+		app.config().Socket = socket
+		app.config().SocketMode = "0660"
+
+		// a stale socket file is replaced
+		stale, err := net.Listen("unix", socket)
+		require.NoError(t, err)
+		stale.(*net.UnixListener).SetUnlinkOnClose(false)
+		_ = stale.Close()
+
+		umask := syscall.Umask(0o022)
+		syscall.Umask(umask)
+		listeners, err := app.listeners()
+		require.NoError(t, err)
+		require.Len(t, listeners, 1)
+		info, err := os.Stat(socket)
+		require.NoError(t, err)
+		assert.Equal(t, fs.FileMode(0o660), info.Mode().Perm())
+		// the umask is restored
+		assert.Equal(t, umask, syscall.Umask(umask))
+
+		var clientIP string
+		server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			clientIP = app.clientIP(r)
+		})}
+		go func() { _ = server.Serve(listeners[0]) }()
+		defer server.Close()
+
+		client := &http.Client{Transport: &http.Transport{DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		}}}
+		req, _ := http.NewRequest("GET", "http://goshort/", nil)
+		// the proxy in front of the socket is trusted
+		req.Header.Set("X-Forwarded-For", "1.2.3.4")
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		assert.Equal(t, "1.2.3.4", clientIP)
+	})
+	t.Run("Invalid socket configs", func(t *testing.T) {
+		file := filepath.Join(t.TempDir(), "file")
+		require.NoError(t, os.WriteFile(file, nil, 0o644))
+		_, err := listenUnix(file, "")
+		assert.ErrorContains(t, err, "is not a socket")
+		_, err = listenUnix(filepath.Join(t.TempDir(), "s"), "999")
+		assert.ErrorContains(t, err, "invalid socket mode")
+	})
+	t.Run("TCP on a specific address", func(t *testing.T) {
+		app := testApp(t)
+		defer closeTestApp(t, app)
+		app.config().Address = "127.0.0.1"
+		app.config().Port = 0
+		listeners, err := app.listeners()
+		require.NoError(t, err)
+		require.Len(t, listeners, 1)
+		defer listeners[0].Close()
+		assert.True(t, strings.HasPrefix(listeners[0].Addr().String(), "127.0.0.1:"))
+	})
+	t.Run("Systemd sockets are only used by the intended process", func(t *testing.T) {
+		t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+		t.Setenv("LISTEN_FDS", "1")
+		listeners, err := systemdListeners()
+		assert.NoError(t, err)
+		assert.Empty(t, listeners)
+	})
+}
+
+func Test_clientIPWithoutAddress(t *testing.T) {
+	app := &app{}
+	req := httptest.NewRequest("GET", "http://example.com/", nil)
+	req.RemoteAddr = "@"
+	assert.Equal(t, "@", app.clientIP(req))
+	req.Header.Set("X-Forwarded-For", "5.6.7.8")
+	assert.Equal(t, "5.6.7.8", app.clientIP(req))
+}
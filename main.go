@@ -2,109 +2,262 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
+	"errors"
 	"fmt"
 	"html"
 	"html/template"
 	"io"
 	"log"
-	"math/rand/v2"
 	"net/http"
+	"net/netip"
 	"net/url"
 	"os"
-	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	gsd "git.jlel.se/jlelse/go-shutdowner"
+	"github.com/coreos/go-oidc/v3/oidc"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/spf13/viper"
-	"zombiezen.com/go/sqlite"
-	"zombiezen.com/go/sqlite/sqlitex"
 )
 
 type app struct {
-	config   *config
-	dbpool   *sqlitex.Pool
+	// current config, replaced as a whole on reload
+	conf     atomic.Pointer[config]
+	db       storage
 	write    sync.Mutex
 	shutdown gsd.Shutdowner
 	// hits aggregation
-	hitsChan chan string
+	hitsChan chan click
 	hitsWG   sync.WaitGroup
+	// secret of the current day for visitor hashes
+	saltMu  sync.Mutex
+	saltDay int64
+	salt    []byte
+	// resolved slugs for redirects
+	cache *linkCache
+	// blocked destination domains
+	blocklist blocklist
+	// slug generation state
+	slugs         slugGenerator
+	reservedSlugs map[string]bool
+	// rate limiting
+	trustedProxies    []netip.Prefix
+	redirectLimiter   *rateLimiter
+	authLimiter       *rateLimiter
+	failedAuthLimiter *rateLimiter
+	// discovered OpenID Connect provider
+	oidcMu   sync.Mutex
+	provider *oidc.Provider
+	// discovered endpoints of the IndieAuth profile URL
+	indieAuthMu sync.Mutex
+	indieAuth   *indieAuthEndpoints
+}
+
+func newApp(cfg *config) *app {
+	a := &app{}
+	a.conf.Store(cfg)
+	return a
+}
+
+// config returns the current config, callers shouldn't keep it around as it can change on reload
+func (a *app) config() *config {
+	return a.conf.Load()
 }
 
 type config struct {
 	Port       int    `mapstructure:"port"`
 	DBPath     string `mapstructure:"dbPath"`
-	Password   string `mapstructure:"password"`
+	Password   string `mapstructure:"password" secret:"true"`
 	ShortUrl   string `mapstructure:"shortUrl"`
 	DefaultUrl string `mapstructure:"defaultUrl"`
+	// File containing the password (e.g. a Docker secret), overrides password
+	PasswordFile string `mapstructure:"passwordFile"`
+	// PostgreSQL connection URL, the SQLite database at dbPath is used if empty
+	DatabaseUrl string `mapstructure:"databaseUrl" secret:"true"`
+	// Address of the interface to listen on, all interfaces if empty
+	Address string `mapstructure:"address"`
+	// Unix socket to listen on instead of a TCP port
+	Socket string `mapstructure:"socket"`
+	// Permissions of the Unix socket file, like 0660
+	SocketMode string `mapstructure:"socketMode"`
+	// How long deleted links are kept in the trash, 0 keeps them forever
+	TrashRetention time.Duration `mapstructure:"trashRetention"`
+	// Periodic checks of link destinations
+	HealthCheck healthCheckConfig `mapstructure:"healthCheck"`
+	// Rules for allowed destinations
+	Policy policyConfig `mapstructure:"policy"`
+	// Rate limits per client IP
+	RateLimit rateLimitConfig `mapstructure:"rateLimit"`
+	// Generation of slugs
+	Slugs slugConfig `mapstructure:"slugs"`
+	// Additional slugs that can't be used for links
+	ReservedSlugs []string `mapstructure:"reservedSlugs"`
+	// Case-insensitive and Unicode normalized slugs
+	SlugNormalization bool `mapstructure:"slugNormalization"`
+	// Built-in HTTPS
+	TLS tlsConfig `mapstructure:"tls"`
+	// In-memory cache for redirects
+	Cache cacheConfig `mapstructure:"cache"`
+	// Scheduled database backups
+	Backup backupConfig `mapstructure:"backup"`
+	// Statistics of single clicks
+	Clicks clicksConfig `mapstructure:"clicks"`
+	// Logins with the login page
+	Session sessionConfig `mapstructure:"session"`
+	// Don't accept the password as query or form parameter
+	DisablePasswordParam bool `mapstructure:"disablePasswordParam"`
+	// Single sign-on with OpenID Connect
+	OIDC oidcConfig `mapstructure:"oidc"`
+	// Admin login and Micropub with IndieAuth
+	IndieAuth indieAuthConfig `mapstructure:"indieAuth"`
 }
 
 func (a *app) initRouter() (router *chi.Mux) {
+	a.initRateLimiters()
 	router = chi.NewMux()
 	router.Use(middleware.GetHead)
 	router.Group(func(r chi.Router) {
+		r.Use(a.rateLimitMiddleware(a.authLimiter))
 		r.Use(a.loginMiddleware)
-		r.Get("/s", shortenFormHandler)
-		r.Post("/s", a.shortenHandler)
-		r.Get("/t", shortenTextFormHandler)
-		r.Post("/t", a.shortenTextHandler)
-		r.Get("/u", updateFormHandler)
-		r.Get("/ut", updateTextFormHandler)
-		r.Post("/u", a.updateHandler)
-		r.Get("/d", deleteFormHandler)
-		r.Post("/d", a.deleteHandler)
-		r.Get("/l", a.listHandler)
+		// The share target verifies the CSRF token itself to ask for a confirmation instead
+		r.Post("/share", a.shareHandler)
+		r.Group(func(r chi.Router) {
+			r.Use(a.csrfMiddleware)
+			r.Get("/s", a.shortenFormHandler)
+			r.Post("/s", a.shortenHandler)
+			r.Get("/t", a.shortenTextFormHandler)
+			r.Post("/t", a.shortenTextHandler)
+			r.Get("/u", a.updateFormHandler)
+			r.Get("/ut", a.updateTextFormHandler)
+			r.Post("/u", a.updateHandler)
+			r.Get("/d", a.deleteFormHandler)
+			r.Post("/d", a.deleteHandler)
+			r.Get("/l", a.listHandler)
+			r.Get("/h", a.historyHandler)
+			r.Get("/stats", a.statsHandler)
+			r.Post("/r", a.rollbackHandler)
+			r.Get("/rename", a.renameFormHandler)
+			r.Post("/rename", a.renameHandler)
+			r.Get("/trash", a.trashHandler)
+			r.Post("/restore", a.restoreHandler)
+			r.With(requireAdmin).Post("/purge", a.purgeHandler)
+			r.Get("/broken", a.brokenHandler)
+			r.With(requireAdmin).Get("/metrics", a.metricsHandler)
+			r.With(requireAdmin).Get("/backup", a.backupHandler)
+			r.Post("/logout", a.logoutHandler)
+		})
+	})
+	router.Group(func(r chi.Router) {
+		r.Use(a.rateLimitMiddleware(a.authLimiter))
+		// Micropub clients send access tokens instead of cookies, so there's no CSRF token
+		r.Use(a.micropubMiddleware)
+		r.Get("/micropub", a.micropubQueryHandler)
+		r.Post("/micropub", a.micropubHandler)
 	})
-	router.Get("/{slug}", a.shortenedURLHandler)
-	router.Get("/", a.defaultURLRedirectHandler)
+	router.Group(func(r chi.Router) {
+		r.Use(a.rateLimitMiddleware(a.redirectLimiter))
+		r.Get("/login", a.loginFormHandler)
+		r.Post("/login", a.loginHandler)
+		r.Get("/oidc/login", a.oidcLoginHandler)
+		r.Get("/oidc/callback", a.oidcCallbackHandler)
+		r.Get("/indieauth/login", a.indieAuthLoginHandler)
+		r.Get("/indieauth/callback", a.indieAuthCallbackHandler)
+		r.Get("/openapi.json", openAPIHandler)
+		r.Get("/openapi", docsHandler)
+		r.Get("/manifest.webmanifest", staticHandler("application/manifest+json", manifest))
+		r.Get("/sw.js", staticHandler("text/javascript", serviceWorker))
+		r.Get("/icon.svg", staticHandler("image/svg+xml", iconSVG))
+		r.Get("/icon-192.png", staticHandler("image/png", icon192))
+		r.Get("/icon-512.png", staticHandler("image/png", icon512))
+		r.Get("/{slug}", a.shortenedURLHandler)
+		r.Get("/", a.defaultURLRedirectHandler)
+	})
+	a.initReservedSlugs(router)
 	return
 }
 
 func main() {
-	viper.SetDefault("dbPath", "data/goshort.db")
-	viper.SetDefault("port", 8080)
+	cfg, args, err := loadConfig(viper.GetViper(), os.Args[1:])
+	if err != nil {
+		log.Fatal("Failed to load config: ", err.Error())
+		return
+	}
+	if len(args) > 0 {
+		os.Exit(runCommand(args, cfg, viper.GetViper()))
+		return
+	}
+	if err := validateConfig(cfg); err != nil {
+		log.Fatal("Invalid config: ", err.Error())
+		return
+	}
+
+	app := newApp(cfg)
 
-	viper.SetConfigName("config")
-	viper.AddConfigPath("./config")
-	viper.AddConfigPath(".")
-	_ = viper.ReadInConfig()
+	err = app.openDatabase()
+	if err != nil {
+		log.Println("Error opening database:", err.Error())
+		app.shutdown.ShutdownAndWait()
+		os.Exit(1)
+		return
+	}
 
-	if !viper.IsSet("password") {
-		log.Fatal("No password (password) is configured.")
+	err = app.migrateSlugNormalization(context.Background())
+	if err != nil {
+		log.Println("Error enabling slug normalization:", err.Error())
+		app.shutdown.ShutdownAndWait()
+		os.Exit(1)
 		return
 	}
-	if !viper.IsSet("shortUrl") {
-		log.Fatal("No short URL (shortUrl) is configured.")
+
+	err = app.initPolicy()
+	if err != nil {
+		log.Println("Error loading policy:", err.Error())
+		app.shutdown.ShutdownAndWait()
+		os.Exit(1)
 		return
 	}
-	if !viper.IsSet("defaultUrl") {
-		log.Fatal("No default URL (defaultUrl) is configured.")
+
+	err = app.initSlugGenerator()
+	if err != nil {
+		log.Println("Error configuring slug generation:", err.Error())
+		app.shutdown.ShutdownAndWait()
+		os.Exit(1)
 		return
 	}
 
-	app := &app{}
+	app.startHealthChecker()
+
+	router := app.initRouter()
+	if _, err := app.checkShadowedSlugs(context.Background()); err != nil {
+		log.Println("Failed to check for shadowed links:", err.Error())
+	}
 
-	app.config = &config{}
-	err := viper.Unmarshal(app.config)
+	app.watchConfig()
+
+	tlsConfig, redirectHandler, err := app.initTLS()
 	if err != nil {
-		log.Fatal("Failed to unmarshal config:", err.Error())
+		log.Println("Error configuring TLS:", err.Error())
+		app.shutdown.ShutdownAndWait()
+		os.Exit(1)
 		return
 	}
 
-	err = app.openDatabase()
+	listeners, err := app.listeners()
 	if err != nil {
-		log.Println("Error opening database:", err.Error())
+		log.Println("Error listening:", err.Error())
 		app.shutdown.ShutdownAndWait()
 		os.Exit(1)
 		return
 	}
 
 	httpServer := &http.Server{
-		Addr:         ":" + strconv.Itoa(app.config.Port),
-		Handler:      app.initRouter(),
+		Handler:      router,
+		TLSConfig:    tlsConfig,
 		ReadTimeout:  5 * time.Minute,
 		WriteTimeout: 5 * time.Minute,
 	}
@@ -116,65 +269,100 @@ func main() {
 		}
 		log.Println("Stopped server")
 	})
-	go func() {
-		fmt.Println("Listening to " + httpServer.Addr)
-		if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Println("Failed to start HTTP server:", err.Error())
-		}
-	}()
+	for _, listener := range listeners {
+		go func() {
+			fmt.Println("Listening to " + listener.Addr().String())
+			var err error
+			if tlsConfig != nil {
+				err = httpServer.ServeTLS(listener, "", "")
+			} else {
+				err = httpServer.Serve(listener)
+			}
+			if err != nil && err != http.ErrServerClosed {
+				log.Println("Failed to start HTTP server:", err.Error())
+			}
+		}()
+	}
+	app.startRedirectServer(redirectHandler)
 
 	app.shutdown.Wait()
 }
 
 func (a *app) loginMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if !a.checkPassword(w, r) {
+		ip := a.clientIP(r)
+		if blocked, retryAfter := a.failedAuthLimiter.blocked(ip); blocked {
+			tooManyRequests(w, retryAfter)
 			return
 		}
-		next.ServeHTTP(w, r)
+		u, ok := a.sessionUser(r)
+		if !ok {
+			if !a.checkPassword(w, r) {
+				// Requests that still have to log in aren't failed attempts
+				if a.passwordPresented(r) {
+					a.failedAuthLimiter.allow(ip)
+				}
+				return
+			}
+			u = passwordUser
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userContextKey{}, u)))
 	})
 }
 
-func shortenFormHandler(w http.ResponseWriter, r *http.Request) {
-	if err := generateURLForm(w, "Shorten URL", "s", [][]string{{"url", r.FormValue("url")}, {"slug", r.FormValue("slug")}}); err != nil {
+func (a *app) shortenFormHandler(w http.ResponseWriter, r *http.Request) {
+	if err := a.generateURLForm(w, r, "Shorten URL", "s", [][]string{{"url", r.FormValue("url")}, {"slug", r.FormValue("slug")}}); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
 
-func updateFormHandler(w http.ResponseWriter, r *http.Request) {
-	if err := generateURLForm(w, "Update short link", "u", [][]string{{"slug", r.FormValue("slug")}, {"type", "url"}, {"new", r.FormValue("new")}}); err != nil {
+func (a *app) updateFormHandler(w http.ResponseWriter, r *http.Request) {
+	if err := a.generateURLForm(w, r, "Update short link", "u", [][]string{{"slug", r.FormValue("slug")}, {"type", "url"}, {"new", r.FormValue("new")}, {"aliases", a.formAliases(r)}, {"canonical", ""}}); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
 
-func updateTextFormHandler(w http.ResponseWriter, r *http.Request) {
-	if err := generateTextForm(w, "Update text", "u", [][]string{{"slug", r.FormValue("slug")}, {"type", "text"}}, [][]string{{"new", r.FormValue("new")}}); err != nil {
+func (a *app) updateTextFormHandler(w http.ResponseWriter, r *http.Request) {
+	if err := a.generateTextForm(w, r, "Update text", "u", [][]string{{"slug", r.FormValue("slug")}, {"type", "text"}, {"aliases", a.formAliases(r)}, {"canonical", ""}}, [][]string{{"new", r.FormValue("new")}}); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
 
-func deleteFormHandler(w http.ResponseWriter, r *http.Request) {
-	if err := generateURLForm(w, "Delete short link", "d", [][]string{{"slug", r.FormValue("slug")}}); err != nil {
+// formAliases returns the aliases to prefill the update form with, the current ones if not specified
+func (a *app) formAliases(r *http.Request) string {
+	if aliases, ok := r.URL.Query()["aliases"]; ok {
+		return strings.Join(aliases, ", ")
+	}
+	slug := a.requestSlug(r)
+	if slug == "" {
+		return ""
+	}
+	aliases, _ := a.getAliases(r.Context(), slug)
+	return strings.Join(aliases, ", ")
+}
+
+func (a *app) deleteFormHandler(w http.ResponseWriter, r *http.Request) {
+	if err := a.generateURLForm(w, r, "Delete short link", "d", [][]string{{"slug", r.FormValue("slug")}}); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
 
-func shortenTextFormHandler(w http.ResponseWriter, r *http.Request) {
-	if err := generateTextForm(w, "Save text", "t", [][]string{{"slug", r.FormValue("slug")}}, [][]string{{"text", r.FormValue("text")}}); err != nil {
+func (a *app) shortenTextFormHandler(w http.ResponseWriter, r *http.Request) {
+	if err := a.generateTextForm(w, r, "Save text", "t", [][]string{{"slug", r.FormValue("slug")}}, [][]string{{"text", r.FormValue("text")}}); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
 
-func generateURLForm(w http.ResponseWriter, title string, url string, fields [][]string) error {
-	return urlFormTemplate.Execute(w, &templateData{Style: template.CSS(styleCSS), Data: map[string]any{
+func (a *app) generateURLForm(w http.ResponseWriter, r *http.Request, title string, url string, fields [][]string) error {
+	return urlFormTemplate.Execute(w, &templateData{Style: template.CSS(styleCSS), CSRF: a.csrfToken(r), Data: map[string]any{
 		"Title":  title,
 		"URL":    url,
 		"Fields": fields,
 	}})
 }
 
-func generateTextForm(w http.ResponseWriter, title string, url string, fields [][]string, textAreas [][]string) error {
-	return textFormTemplate.Execute(w, &templateData{Style: template.CSS(styleCSS), Data: map[string]any{
+func (a *app) generateTextForm(w http.ResponseWriter, r *http.Request, title string, url string, fields [][]string, textAreas [][]string) error {
+	return textFormTemplate.Execute(w, &templateData{Style: template.CSS(styleCSS), CSRF: a.csrfToken(r), Data: map[string]any{
 		"Title":     title,
 		"URL":       url,
 		"Fields":    fields,
@@ -184,7 +372,7 @@ func generateTextForm(w http.ResponseWriter, title string, url string, fields []
 
 func (a *app) shortenHandler(w http.ResponseWriter, r *http.Request) {
 	writeShortenedURL := func(w http.ResponseWriter, slug string) {
-		short, _ := url.JoinPath(a.config.ShortUrl, slug)
+		short, _ := url.JoinPath(a.config().ShortUrl, slug)
 		_, _ = io.WriteString(w, html.EscapeString(short))
 	}
 
@@ -193,21 +381,25 @@ func (a *app) shortenHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "url parameter not set", http.StatusBadRequest)
 		return
 	}
+	if err := a.checkLink(typUrl, requestURL); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	slug := r.FormValue("slug")
+	slug := a.normalizeSlug(r.FormValue("slug"))
 	manualSlug := false
 	if slug == "" {
-		conn, _ := a.dbpool.Take(r.Context())
-		defer a.dbpool.Put(conn)
-		_ = sqlitex.Execute(conn, "SELECT slug FROM redirect WHERE url = ?", &sqlitex.ExecOptions{
-			Args: []any{requestURL},
-			ResultFunc: func(stmt *sqlite.Stmt) error {
-				slug = stmt.ColumnText(0)
-				return nil
-			},
-		})
+		slug, _ = a.db.findLink(r.Context(), requestURL, typUrl)
 	} else {
 		manualSlug = true
+		if a.slugReserved(slug) {
+			http.Error(w, errReservedSlug, http.StatusBadRequest)
+			return
+		}
+		if err := a.validateSlug(slug); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 	}
 
 	if slug != "" {
@@ -220,15 +412,11 @@ func (a *app) shortenHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	} else {
-		exists := true
 		var err error
-		for exists {
-			slug = generateSlug()
-			exists, err = a.slugExists(slug)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
+		slug, err = a.newSlug(r.Context(), requestURL)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
 	}
 
@@ -241,42 +429,37 @@ func (a *app) shortenHandler(w http.ResponseWriter, r *http.Request) {
 	writeShortenedURL(w, slug)
 }
 
-// startHitsAggregator starts a background worker that batches hit increments.
+// startHitsAggregator starts a background worker that batches clicks and hit increments.
 func (a *app) startHitsAggregator() {
 	a.hitsWG.Go(func() {
-		counts := make(map[string]int)
+		var clicks []click
 		ticker := time.NewTicker(500 * time.Millisecond)
 		defer ticker.Stop()
 		flush := func() {
-			if len(counts) == 0 {
+			if len(clicks) == 0 {
 				return
 			}
 			// copy and reset
-			local := counts
-			counts = make(map[string]int)
+			local := clicks
+			clicks = nil
 			// perform updates in a transaction
 			a.write.Lock()
-			conn, err := a.dbpool.Take(context.Background())
-			if err == nil {
-				_ = sqlitex.ExecuteTransient(conn, "BEGIN", nil)
-				for slug, cnt := range local {
-					_ = sqlitex.Execute(conn, "UPDATE redirect SET hits = hits + ? WHERE slug = ?", &sqlitex.ExecOptions{Args: []any{cnt, slug}})
-				}
-				_ = sqlitex.ExecuteTransient(conn, "COMMIT", nil)
-				a.dbpool.Put(conn)
-			}
+			err := a.db.recordClicks(context.Background(), local)
 			a.write.Unlock()
+			if err != nil {
+				log.Println("Failed to save clicks:", err.Error())
+			}
 		}
 		for {
 			select {
-			case s, ok := <-a.hitsChan:
+			case c, ok := <-a.hitsChan:
 				if !ok {
 					flush()
 					return
 				}
-				counts[s]++
+				clicks = append(clicks, c)
 				// flush if too many accumulated
-				if len(counts) > 500 {
+				if len(clicks) > 500 {
 					flush()
 				}
 			case <-ticker.C:
@@ -294,7 +477,7 @@ func (a *app) startHitsAggregator() {
 
 func (a *app) shortenTextHandler(w http.ResponseWriter, r *http.Request) {
 	writeShortenedURL := func(w http.ResponseWriter, slug string) {
-		short, _ := url.JoinPath(a.config.ShortUrl, slug)
+		short, _ := url.JoinPath(a.config().ShortUrl, slug)
 		_, _ = io.WriteString(w, html.EscapeString(short))
 	}
 
@@ -304,20 +487,20 @@ func (a *app) shortenTextHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	slug := r.FormValue("slug")
+	slug := a.normalizeSlug(r.FormValue("slug"))
 	manualSlug := false
 	if slug == "" {
-		conn, _ := a.dbpool.Take(r.Context())
-		defer a.dbpool.Put(conn)
-		_ = sqlitex.Execute(conn, "SELECT slug FROM redirect WHERE url = ? and type = 'text'", &sqlitex.ExecOptions{
-			Args: []any{requestText},
-			ResultFunc: func(stmt *sqlite.Stmt) error {
-				slug = stmt.ColumnText(0)
-				return nil
-			},
-		})
+		slug, _ = a.db.findLink(r.Context(), requestText, typText)
 	} else {
 		manualSlug = true
+		if a.slugReserved(slug) {
+			http.Error(w, errReservedSlug, http.StatusBadRequest)
+			return
+		}
+		if err := a.validateSlug(slug); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 	}
 
 	if slug != "" {
@@ -330,15 +513,11 @@ func (a *app) shortenTextHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	} else {
-		exists := true
 		var err error
-		for exists {
-			slug = generateSlug()
-			exists, err = a.slugExists(slug)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
+		slug, err = a.newSlug(r.Context(), requestText)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
 	}
 
@@ -352,7 +531,7 @@ func (a *app) shortenTextHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func (a *app) updateHandler(w http.ResponseWriter, r *http.Request) {
-	slug := r.FormValue("slug")
+	slug := a.requestSlug(r)
 	if slug == "" {
 		http.Error(w, "Specify the slug to update", http.StatusBadRequest)
 		return
@@ -366,15 +545,37 @@ func (a *app) updateHandler(w http.ResponseWriter, r *http.Request) {
 
 	typeString := r.FormValue("type")
 	if typeString == "" {
-		typeString = "url"
+		typeString = typUrl
+	}
+	if err := a.checkLink(typeString, newURL); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	if e, err := a.slugExists(slug); err != nil || !e {
-		http.NotFound(w, r)
+	if a.slugReserved(slug) {
+		http.Error(w, errReservedSlug, http.StatusBadRequest)
 		return
 	}
 
-	if err := a.updateSlug(r.Context(), newURL, typeString, slug); err != nil {
+	// Aliases are only changed if the parameter is present, an empty value removes all aliases
+	var aliases *string
+	if _, ok := r.Form["aliases"]; ok {
+		list := r.FormValue("aliases")
+		aliases = &list
+	}
+	canonical := a.normalizeSlug(r.FormValue("canonical"))
+	if canonical == slug {
+		canonical = ""
+	}
+
+	var reqErr requestError
+	if err := a.updateLink(r.Context(), slug, newURL, typeString, aliases, canonical); errors.Is(err, errSlugNotFound) {
+		http.NotFound(w, r)
+		return
+	} else if errors.As(err, &reqErr) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -384,13 +585,13 @@ func (a *app) updateHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func (a *app) deleteHandler(w http.ResponseWriter, r *http.Request) {
-	slug := r.FormValue("slug")
+	slug := a.requestSlug(r)
 	if slug == "" {
 		http.Error(w, "Specify the slug to delete", http.StatusBadRequest)
 		return
 	}
 
-	if e, err := a.slugExists(slug); !e || err != nil {
+	if e, err := a.slugActive(slug); !e || err != nil {
 		http.NotFound(w, r)
 		return
 	}
@@ -401,16 +602,18 @@ func (a *app) deleteHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	w.WriteHeader(http.StatusAccepted)
-	_, _ = io.WriteString(w, "Slug deleted")
+	_, _ = io.WriteString(w, "Slug moved to trash")
 }
 
 func (a *app) listHandler(w http.ResponseWriter, r *http.Request) {
 	type row struct {
-		Slug  string
-		URL   string
-		Type  string
-		Hits  int
-		Short string
+		Slug    string
+		URL     string
+		Type    string
+		Hits    int
+		Short   string
+		Broken  string
+		Aliases string
 	}
 	var list []row
 
@@ -431,41 +634,21 @@ func (a *app) listHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	var orderBy string
-	swi := func(s string) string { return strings.ToUpper(s) }
-	switch sort {
-	case "slug":
-		orderBy = "slug COLLATE NOCASE " + swi(effectiveDir)
-	case "hits":
-		orderBy = "hits " + swi(effectiveDir)
-	case "url":
-		orderBy = "url COLLATE NOCASE " + swi(effectiveDir)
-	default:
-		orderBy = "created " + swi(effectiveDir)
-	}
-
-	query := "SELECT slug, url, type, hits FROM redirect ORDER BY " + orderBy
-
-	conn, _ := a.dbpool.Take(r.Context())
-	err := sqlitex.Execute(conn, query, &sqlitex.ExecOptions{
-		ResultFunc: func(stmt *sqlite.Stmt) error {
-			var r row
-			r.Slug = stmt.ColumnText(0)
-			r.URL = stmt.ColumnText(1)
-			r.Type = stmt.ColumnText(2)
-			r.Hits = stmt.ColumnInt(3)
-			if s, _ := url.JoinPath(a.config.ShortUrl, r.Slug); s != "" {
-				r.Short = s
-			}
-			list = append(list, r)
-			return nil
-		},
-	})
-	a.dbpool.Put(conn)
+	links, err := a.db.listLinks(r.Context(), linkOrder(sort), effectiveDir == "desc")
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	for _, l := range links {
+		r := row{Slug: l.slug, URL: l.url, Type: l.typ, Hits: l.hits, Aliases: l.aliases}
+		if l.check.broken() {
+			r.Broken = checkStatusText(l.check.Status, l.check.Error)
+		}
+		if s, _ := url.JoinPath(a.config().ShortUrl, r.Slug); s != "" {
+			r.Short = s
+		}
+		list = append(list, r)
+	}
 
 	defaultDir := func(col string) string {
 		if col == "hits" {
@@ -529,68 +712,85 @@ func (a *app) listHandler(w http.ResponseWriter, r *http.Request) {
 		UrlIndicator:  indicator("url"),
 	}
 
-	err = listTemplate.Execute(w, &templateData{Style: template.CSS(styleCSS), Data: pd})
+	err = listTemplate.Execute(w, &templateData{Style: template.CSS(styleCSS), CSRF: a.csrfToken(r), Data: pd})
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 }
 
+// passwordMatches reports whether the password is the configured one, no password
+// matches if only single sign-on is configured
+func (a *app) passwordMatches(password string) bool {
+	configured := a.config().Password
+	return configured != "" && subtle.ConstantTimeCompare([]byte(password), []byte(configured)) == 1
+}
+
+// passwordPresented reports whether the request carries a password that checkPassword checks
+func (a *app) passwordPresented(r *http.Request) bool {
+	if _, _, ok := r.BasicAuth(); ok {
+		return true
+	}
+	if strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+		return true
+	}
+	return !a.config().DisablePasswordParam && r.FormValue("password") != ""
+}
+
 func (a *app) checkPassword(w http.ResponseWriter, r *http.Request) bool {
 	// Check basic auth
-	if _, pass, ok := r.BasicAuth(); ok && pass == a.config.Password {
+	if _, pass, ok := r.BasicAuth(); ok && a.passwordMatches(pass) {
+		return true
+	}
+	// Check bearer token
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && a.passwordMatches(token) {
 		return true
 	}
 	// Check query or form param
-	if r.FormValue("password") == a.config.Password {
+	if !a.config().DisablePasswordParam && a.passwordMatches(r.FormValue("password")) {
 		return true
 	}
+	// Send browsers to the login page
+	if r.Method == http.MethodGet && strings.Contains(r.Header.Get("Accept"), "text/html") {
+		loginRedirect(w, r)
+		return false
+	}
 	// Require password
 	w.Header().Set("WWW-Authenticate", `Basic realm="Please enter a password!"`)
 	http.Error(w, "Not authenticated", http.StatusUnauthorized)
 	return false
 }
 
-func generateSlug() string {
-	const chars = "0123456789abcdefghijklmnopqrstuvwxyz"
-	b := make([]byte, 6)
-	for i := range b {
-		b[i] = chars[rand.IntN(len(chars))]
-	}
-	return string(b)
-}
-
 func (a *app) shortenedURLHandler(w http.ResponseWriter, r *http.Request) {
-	slug := chi.URLParam(r, "slug")
-
-	var redirectURL, typeString string
-
-	conn, _ := a.dbpool.Take(r.Context())
-	err := sqlitex.Execute(conn, "SELECT url, type FROM redirect WHERE slug = ? LIMIT 1", &sqlitex.ExecOptions{
-		Args: []any{slug},
-		ResultFunc: func(stmt *sqlite.Stmt) error {
-			redirectURL = stmt.ColumnText(0)
-			typeString = stmt.ColumnText(1)
-			return nil
-		},
-	})
-	a.dbpool.Put(conn)
+	slug := a.normalizeSlug(chi.URLParam(r, "slug"))
+
+	cl, ok := a.cache.get(slug)
+	if !ok {
+		// Resolve aliases to their link
+		link, err := a.db.resolveLink(r.Context(), slug)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		cl = &cachedLink{slug: slug, link: link.slug, url: link.url, typ: link.typ}
+		a.cache.put(cl)
+	}
 
-	if err != nil || redirectURL == "" || typeString == "" {
+	if cl.url == "" || cl.typ == "" {
 		http.NotFound(w, r)
 		return
 	}
 
-	a.increaseHits(slug)
+	a.increaseHits(a.newClick(r, cl.link))
 
-	switch typeString {
+	switch cl.typ {
 	case typText:
-		_, _ = io.WriteString(w, redirectURL)
+		_, _ = io.WriteString(w, cl.url)
 	default:
-		http.Redirect(w, r, redirectURL, http.StatusTemporaryRedirect)
+		http.Redirect(w, r, cl.url, http.StatusTemporaryRedirect)
 	}
 }
 
 func (a *app) defaultURLRedirectHandler(w http.ResponseWriter, r *http.Request) {
-	http.Redirect(w, r, a.config.DefaultUrl, http.StatusTemporaryRedirect)
+	http.Redirect(w, r, a.config().DefaultUrl, http.StatusTemporaryRedirect)
 }
@@ -1,33 +1,120 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	embeddedpostgres "github.com/fergusstrange/embedded-postgres"
+	"github.com/jackc/pgx/v5"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
-	"zombiezen.com/go/sqlite"
-	"zombiezen.com/go/sqlite/sqlitex"
 )
 
+// testDatabaseUrl is the PostgreSQL server of the second test run, see TestMain
+var testDatabaseUrl string
+
+// TestMain runs all tests against SQLite and, if GOSHORT_TEST_DATABASE_URL is
+// set, again against PostgreSQL: either the server of the URL or, for "embedded",
+// an embedded server whose binaries are downloaded on first use. -short only
+// runs the tests against SQLite.
+func TestMain(m *testing.M) {
+	code := m.Run()
+	databaseUrl := os.Getenv("GOSHORT_TEST_DATABASE_URL")
+	if code != 0 || testing.Short() || databaseUrl == "" {
+		os.Exit(code)
+	}
+	stop := func() {}
+	if databaseUrl == "embedded" {
+		var err error
+		databaseUrl, stop, err = startTestPostgres()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to start the embedded PostgreSQL server:", err.Error())
+			os.Exit(1)
+		}
+	}
+	fmt.Println("Running the tests against PostgreSQL")
+	testDatabaseUrl = databaseUrl
+	code = m.Run()
+	stop()
+	os.Exit(code)
+}
+
+// startTestPostgres starts an embedded PostgreSQL server on a free port
+func startTestPostgres() (databaseUrl string, stop func(), err error) {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		return "", nil, err
+	}
+	port := uint32(listener.Addr().(*net.TCPAddr).Port)
+	_ = listener.Close()
+	runtimePath, err := os.MkdirTemp("", "goshort-postgres")
+	if err != nil {
+		return "", nil, err
+	}
+	var logs bytes.Buffer
+	cfg := embeddedpostgres.DefaultConfig().
+		Port(port).
+		RuntimePath(runtimePath).
+		StartTimeout(time.Minute).
+		Logger(&logs)
+	db := embeddedpostgres.NewDatabase(cfg)
+	if err := db.Start(); err != nil {
+		_ = os.RemoveAll(runtimePath)
+		return "", nil, fmt.Errorf("%w\n%s", err, logs.String())
+	}
+	return cfg.GetConnectionURL() + "?sslmode=disable", func() {
+		_ = db.Stop()
+		_ = os.RemoveAll(runtimePath)
+	}, nil
+}
+
 func testApp(t *testing.T) *app {
-	app := &app{
-		config: &config{
-			DBPath: filepath.Join(t.TempDir(), "data.db"),
-		},
+	cfg := &config{
+		DBPath: filepath.Join(t.TempDir(), "data.db"),
 	}
+	if testDatabaseUrl != "" {
+		cfg.DatabaseUrl = testPostgresSchema(t, testDatabaseUrl)
+	}
+	app := newApp(cfg)
 	err := app.openDatabase()
 	require.NoError(t, err)
 	return app
 }
 
+// testPostgresSchema creates a schema that is dropped after the test and returns
+// the database URL using it, so every test starts with an empty database
+func testPostgresSchema(t *testing.T, databaseUrl string) string {
+	ctx := context.Background()
+	conn, err := pgx.Connect(ctx, databaseUrl)
+	require.NoError(t, err)
+	schema := "goshort_test_" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	_, err = conn.Exec(ctx, "CREATE SCHEMA "+schema)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_, _ = conn.Exec(ctx, "DROP SCHEMA "+schema+" CASCADE")
+		_ = conn.Close(ctx)
+	})
+	u, err := url.Parse(databaseUrl)
+	require.NoError(t, err)
+	query := u.Query()
+	query.Set("search_path", schema)
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
 func closeTestApp(_ *testing.T, app *app) {
 	app.shutdown.ShutdownAndWait()
 }
@@ -47,17 +134,11 @@ func Test_slugExists(t *testing.T) {
 	})
 }
 
-func Test_generateSlug(t *testing.T) {
-	t.Run("Test slug generation", func(t *testing.T) {
-		assert.Len(t, generateSlug(), 6)
-	})
-}
-
 func TestShortenedUrlHandler(t *testing.T) {
 	t.Run("Test ShortenedUrlHandler", func(t *testing.T) {
 		app := testApp(t)
 
-		app.config.DefaultUrl = "http://long.example.com"
+		app.config().DefaultUrl = "http://long.example.com"
 
 		router := app.initRouter()
 
@@ -128,7 +209,7 @@ func TestShortenedUrlHandler(t *testing.T) {
 func Test_checkPassword(t *testing.T) {
 	app := testApp(t)
 
-	app.config.Password = "abc"
+	app.config().Password = "abc"
 
 	t.Run("No password", func(t *testing.T) {
 		req := httptest.NewRequest("GET", "http://example.com/test", nil)
@@ -190,22 +271,19 @@ func TestListSorting(t *testing.T) {
 	t.Run("Test list sorting", func(t *testing.T) {
 		app := testApp(t)
 		defer closeTestApp(t, app)
-		app.config.Password = "abc"
+		app.config().Password = "abc"
 
 		require.NoError(t, app.insertRedirect("a", "https://a.example", typUrl))
 		require.NoError(t, app.insertRedirect("m", "https://m.example", typUrl))
 		require.NoError(t, app.insertRedirect("z", "https://z.example", typUrl))
 
 		// set created timestamps
-		conn, err := app.dbpool.Take(context.Background())
+		_, err := app.db.exec(context.Background(), "UPDATE redirect SET created = ? WHERE slug = ?", time.Now().Unix()-300, "a")
 		require.NoError(t, err)
-		err = sqlitex.Execute(conn, "UPDATE redirect SET created = ? WHERE slug = ?", &sqlitex.ExecOptions{Args: []any{time.Now().Unix() - 300, "a"}})
+		_, err = app.db.exec(context.Background(), "UPDATE redirect SET created = ? WHERE slug = ?", time.Now().Unix()-100, "m")
 		require.NoError(t, err)
-		err = sqlitex.Execute(conn, "UPDATE redirect SET created = ? WHERE slug = ?", &sqlitex.ExecOptions{Args: []any{time.Now().Unix() - 100, "m"}})
+		_, err = app.db.exec(context.Background(), "UPDATE redirect SET created = ? WHERE slug = ?", time.Now().Unix()-10, "z")
 		require.NoError(t, err)
-		err = sqlitex.Execute(conn, "UPDATE redirect SET created = ? WHERE slug = ?", &sqlitex.ExecOptions{Args: []any{time.Now().Unix() - 10, "z"}})
-		require.NoError(t, err)
-		app.dbpool.Put(conn)
 
 		router := app.initRouter()
 
@@ -236,15 +314,12 @@ func TestListSorting(t *testing.T) {
 		assert.True(t, idxA < idxM && idxM < idxZ)
 
 		// set hits and test hits sort (desc)
-		conn, err = app.dbpool.Take(context.Background())
-		require.NoError(t, err)
-		err = sqlitex.Execute(conn, "UPDATE redirect SET hits = ? WHERE slug = ?", &sqlitex.ExecOptions{Args: []any{10, "a"}})
+		_, err = app.db.exec(context.Background(), "UPDATE redirect SET hits = ? WHERE slug = ?", 10, "a")
 		require.NoError(t, err)
-		err = sqlitex.Execute(conn, "UPDATE redirect SET hits = ? WHERE slug = ?", &sqlitex.ExecOptions{Args: []any{5, "m"}})
+		_, err = app.db.exec(context.Background(), "UPDATE redirect SET hits = ? WHERE slug = ?", 5, "m")
 		require.NoError(t, err)
-		err = sqlitex.Execute(conn, "UPDATE redirect SET hits = ? WHERE slug = ?", &sqlitex.ExecOptions{Args: []any{50, "z"}})
+		_, err = app.db.exec(context.Background(), "UPDATE redirect SET hits = ? WHERE slug = ?", 50, "z")
 		require.NoError(t, err)
-		app.dbpool.Put(conn)
 
 		req = httptest.NewRequest("GET", "http://example.com/l?password=abc&sort=hits", nil)
 		w = httptest.NewRecorder()
@@ -304,8 +379,8 @@ func TestListUI(t *testing.T) {
 	t.Run("List UI elements", func(t *testing.T) {
 		app := testApp(t)
 		defer closeTestApp(t, app)
-		app.config.Password = "abc"
-		app.config.ShortUrl = "https://short.example.com"
+		app.config().Password = "abc"
+		app.config().ShortUrl = "https://short.example.com"
 
 		require.NoError(t, app.insertRedirect("x", "https://x.example", typUrl))
 
@@ -366,15 +441,12 @@ func TestHitsAggregator(t *testing.T) {
 		router := app.initRouter()
 
 		// initial hits
-		conn, err := app.dbpool.Take(context.Background())
-		require.NoError(t, err)
 		var initial int
-		err = sqlitex.Execute(conn, "SELECT hits FROM redirect WHERE slug = ?", &sqlitex.ExecOptions{Args: []any{"source"}, ResultFunc: func(stmt *sqlite.Stmt) error {
+		err := app.db.query(context.Background(), "SELECT hits FROM redirect WHERE slug = ?", func(stmt resultRow) error {
 			initial = stmt.ColumnInt(0)
 			return nil
-		}})
+		}, "source")
 		require.NoError(t, err)
-		app.dbpool.Put(conn)
 
 		// send many hits quickly
 		count := 200
@@ -388,15 +460,12 @@ func TestHitsAggregator(t *testing.T) {
 		time.Sleep(700 * time.Millisecond)
 
 		// check hits increased
-		conn, err = app.dbpool.Take(context.Background())
-		require.NoError(t, err)
 		var after int
-		err = sqlitex.Execute(conn, "SELECT hits FROM redirect WHERE slug = ?", &sqlitex.ExecOptions{Args: []any{"source"}, ResultFunc: func(stmt *sqlite.Stmt) error {
+		err = app.db.query(context.Background(), "SELECT hits FROM redirect WHERE slug = ?", func(stmt resultRow) error {
 			after = stmt.ColumnInt(0)
 			return nil
-		}})
+		}, "source")
 		require.NoError(t, err)
-		app.dbpool.Put(conn)
 
 		assert.True(t, after-initial >= count)
 	})
@@ -409,15 +478,12 @@ func TestHitsNoDrop(t *testing.T) {
 
 		router := app.initRouter()
 
-		conn, err := app.dbpool.Take(context.Background())
-		require.NoError(t, err)
 		var initial int
-		err = sqlitex.Execute(conn, "SELECT hits FROM redirect WHERE slug = ?", &sqlitex.ExecOptions{Args: []any{"source"}, ResultFunc: func(stmt *sqlite.Stmt) error {
+		err := app.db.query(context.Background(), "SELECT hits FROM redirect WHERE slug = ?", func(stmt resultRow) error {
 			initial = stmt.ColumnInt(0)
 			return nil
-		}})
+		}, "source")
 		require.NoError(t, err)
-		app.dbpool.Put(conn)
 
 		// concurrent requests
 		count := 1500
@@ -436,15 +502,12 @@ func TestHitsNoDrop(t *testing.T) {
 		// wait for aggregator flush
 		time.Sleep(1 * time.Second)
 
-		conn, err = app.dbpool.Take(context.Background())
-		require.NoError(t, err)
 		var after int
-		err = sqlitex.Execute(conn, "SELECT hits FROM redirect WHERE slug = ?", &sqlitex.ExecOptions{Args: []any{"source"}, ResultFunc: func(stmt *sqlite.Stmt) error {
+		err = app.db.query(context.Background(), "SELECT hits FROM redirect WHERE slug = ?", func(stmt resultRow) error {
 			after = stmt.ColumnInt(0)
 			return nil
-		}})
+		}, "source")
 		require.NoError(t, err)
-		app.dbpool.Put(conn)
 
 		assert.Equal(t, initial+count, after)
 	})
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"html"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// micropubMiddleware authenticates Micropub clients with the access token of
+// the Authorization header or the access_token parameter. The token is either
+// the password (only in the header if disablePasswordParam is set) or a token of
+// the IndieAuth server of indieAuth.me, which needs the create scope to create links.
+func (a *app) micropubMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := a.clientIP(r)
+		if blocked, retryAfter := a.failedAuthLimiter.blocked(ip); blocked {
+			tooManyRequests(w, retryAfter)
+			return
+		}
+		token, inHeader := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !inHeader {
+			token = r.FormValue("access_token")
+		}
+		if token == "" {
+			micropubError(w, http.StatusUnauthorized, "unauthorized", "No access token was sent")
+			return
+		}
+		u := passwordUser
+		if a.passwordMatches(token) {
+			if !inHeader && a.config().DisablePasswordParam {
+				micropubError(w, http.StatusForbidden, "forbidden", "The password isn't accepted as access_token parameter")
+				return
+			}
+		} else {
+			me, scopes, err := a.verifyAccessToken(r.Context(), token)
+			if errors.Is(err, errInvalidAccessToken) {
+				a.failedAuthLimiter.allow(ip)
+				micropubError(w, http.StatusForbidden, "forbidden", err.Error())
+				return
+			} else if err != nil {
+				log.Println("Failed to verify the access token:", err.Error())
+				micropubError(w, http.StatusBadGateway, "server_error", "The IndieAuth server is not available")
+				return
+			}
+			if r.Method == http.MethodPost && !slices.Contains(scopes, "create") {
+				micropubError(w, http.StatusUnauthorized, "insufficient_scope", "The access token needs the create scope")
+				return
+			}
+			u = user{name: me, role: roleAdmin}
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userContextKey{}, u)))
+	})
+}
+
+func micropubError(w http.ResponseWriter, status int, code, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": code, "error_description": description})
+}
+
+// micropubQueryHandler answers the configuration queries of Micropub clients
+func (a *app) micropubQueryHandler(w http.ResponseWriter, r *http.Request) {
+	var response map[string]any
+	switch r.FormValue("q") {
+	case "config":
+		response = map[string]any{
+			"syndicate-to": []any{},
+			"post-types":   []map[string]string{{"type": "bookmark", "name": "Bookmark"}, {"type": "like", "name": "Like"}},
+		}
+	case "syndicate-to":
+		response = map[string]any{"syndicate-to": []any{}}
+	default:
+		micropubError(w, http.StatusBadRequest, "invalid_request", "Unsupported query")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(response)
+}
+
+// micropubHandler creates a short link for the bookmark-of or like-of URL of a
+// new entry, mp-slug sets the slug
+func (a *app) micropubHandler(w http.ResponseWriter, r *http.Request) {
+	var action string
+	properties := map[string][]any{}
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/json" {
+		var entry struct {
+			Action     string           `json:"action"`
+			Properties map[string][]any `json:"properties"`
+		}
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&entry); err != nil {
+			micropubError(w, http.StatusBadRequest, "invalid_request", err.Error())
+			return
+		}
+		action, properties = entry.Action, entry.Properties
+	} else {
+		if err := r.ParseMultipartForm(10 << 20); err != nil && !errors.Is(err, http.ErrNotMultipart) {
+			micropubError(w, http.StatusBadRequest, "invalid_request", err.Error())
+			return
+		}
+		action = r.PostForm.Get("action")
+		for key, values := range r.PostForm {
+			key = strings.TrimSuffix(key, "[]")
+			for _, v := range values {
+				properties[key] = append(properties[key], v)
+			}
+		}
+	}
+	if action != "" {
+		micropubError(w, http.StatusBadRequest, "invalid_request", "Only creating entries is supported")
+		return
+	}
+	destination := micropubURL(properties["bookmark-of"])
+	if destination == "" {
+		destination = micropubURL(properties["like-of"])
+	}
+	if destination == "" {
+		micropubError(w, http.StatusBadRequest, "invalid_request", "Only entries with bookmark-of or like-of are supported")
+		return
+	}
+	form := url.Values{"url": {destination}}
+	if slug, ok := firstOf(properties["mp-slug"]).(string); ok {
+		form.Set("slug", slug)
+	}
+
+	shortenRequest := r.Clone(r.Context())
+	shortenRequest.Body = http.NoBody
+	shortenRequest.Form, shortenRequest.PostForm = form, form
+	res := &capturedResponse{header: http.Header{}, status: http.StatusOK}
+	a.shortenHandler(res, shortenRequest)
+	if res.status >= 300 {
+		code := "invalid_request"
+		if res.status >= 500 {
+			code = "server_error"
+		}
+		micropubError(w, res.status, code, strings.TrimSpace(res.body.String()))
+		return
+	}
+	w.Header().Set("Location", html.UnescapeString(strings.TrimSpace(res.body.String())))
+	w.WriteHeader(http.StatusCreated)
+	_, _ = w.Write(res.body.Bytes())
+}
+
+func firstOf(values []any) any {
+	if len(values) == 0 {
+		return nil
+	}
+	return values[0]
+}
+
+// micropubURL returns the URL of a property, which is either a plain URL or an
+// embedded h-cite with a url property
+func micropubURL(values []any) string {
+	switch v := firstOf(values).(type) {
+	case string:
+		return strings.TrimSpace(v)
+	case map[string]any:
+		if props, ok := v["properties"].(map[string]any); ok {
+			urls, _ := props["url"].([]any)
+			return micropubURL(urls)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMicropub(t *testing.T) {
+	server := newMockIndieAuthServer(t)
+	app := indieAuthTestApp(t, server)
+	defer closeTestApp(t, app)
+	app.config().Password = "secret"
+	router := app.initRouter()
+
+	send := func(method, contentType, token string, body io.Reader) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "http://example.com/micropub", body)
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	post := func(token string, form url.Values) *httptest.ResponseRecorder {
+		return send("POST", "application/x-www-form-urlencoded", token, strings.NewReader(form.Encode()))
+	}
+	destination := func(slug string) string {
+		var u string
+		_ = app.db.query(context.Background(), "SELECT url FROM redirect WHERE slug = ?", func(stmt resultRow) error {
+			u = stmt.ColumnText(0)
+			return nil
+		}, slug)
+		return u
+	}
+
+	t.Run("Bookmarks create short links", func(t *testing.T) {
+		w := post("create-token", url.Values{"h": {"entry"}, "bookmark-of": {"https://bookmark.example/"}, "mp-slug": {"bookmark"}})
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+		assert.Equal(t, "https://short.example/bookmark", w.Header().Get("Location"))
+		assert.Equal(t, "https://bookmark.example/", destination("bookmark"))
+	})
+	t.Run("Likes as JSON with an embedded citation", func(t *testing.T) {
+		body := `{"type":["h-entry"],"properties":{"like-of":[{"type":["h-cite"],"properties":{"url":["https://like.example/"]}}],"mp-slug":["like"]}}`
+		w := send("POST", "application/json", "create-token", strings.NewReader(body))
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+		assert.Equal(t, "https://short.example/like", w.Header().Get("Location"))
+		assert.Equal(t, "https://like.example/", destination("like"))
+	})
+	t.Run("The password and the access_token parameter work as well", func(t *testing.T) {
+		w := post("", url.Values{"h": {"entry"}, "bookmark-of": {"https://password.example/"}, "access_token": {"secret"}})
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+		slug := strings.TrimPrefix(w.Header().Get("Location"), "https://short.example/")
+		assert.Equal(t, "https://password.example/", destination(slug))
+	})
+	t.Run("The password isn't accepted as parameter if disabled", func(t *testing.T) {
+		app.config().DisablePasswordParam = true
+		defer func() { app.config().DisablePasswordParam = false }()
+		w := post("", url.Values{"h": {"entry"}, "bookmark-of": {"https://param.example/"}, "access_token": {"secret"}})
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		w = post("secret", url.Values{"h": {"entry"}, "bookmark-of": {"https://param.example/"}, "mp-slug": {"header"}})
+		assert.Equal(t, http.StatusCreated, w.Code)
+		// access tokens of IndieAuth are still accepted as parameter
+		w = post("", url.Values{"h": {"entry"}, "bookmark-of": {"https://param.example/"}, "mp-slug": {"param"}, "access_token": {"create-token"}})
+		assert.Equal(t, http.StatusCreated, w.Code)
+	})
+	t.Run("Errors of shortening are passed on", func(t *testing.T) {
+		w := post("create-token", url.Values{"h": {"entry"}, "bookmark-of": {"https://other.example/"}, "mp-slug": {"bookmark"}})
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Contains(t, w.Body.String(), `"error":"invalid_request"`)
+		assert.Contains(t, w.Body.String(), "slug already in use")
+
+		w = post("create-token", url.Values{"h": {"entry"}, "content": {"Hello"}})
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		w = post("create-token", url.Values{"action": {"delete"}, "url": {"https://short.example/bookmark"}})
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Equal(t, "https://bookmark.example/", destination("bookmark"))
+	})
+	t.Run("Access tokens are verified", func(t *testing.T) {
+		form := url.Values{"h": {"entry"}, "bookmark-of": {"https://denied.example/"}}
+		w := post("", form)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		assert.Contains(t, w.Body.String(), `"error":"unauthorized"`)
+		w = post("wrong-token", form)
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		w = post("read-token", form)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		assert.Contains(t, w.Body.String(), `"error":"insufficient_scope"`)
+		// Session cookies aren't accepted, as Micropub requests have no CSRF token
+		req := httptest.NewRequest("POST", "http://example.com/micropub", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(&http.Cookie{Name: sessionCookie, Value: "session"})
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	})
+	t.Run("Config queries", func(t *testing.T) {
+		w := send("GET", "", "read-token", nil)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		req := httptest.NewRequest("GET", "http://example.com/micropub?q=config", nil)
+		req.Header.Set("Authorization", "Bearer read-token")
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+		var cfg map[string]any
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &cfg))
+		assert.Contains(t, cfg, "post-types")
+	})
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Letters of other scripts that look like Latin letters
+const confusableLetters = "аеорсухіјѕԁԛԝһӏ" + "αοιϳνκρτυχ"
+
+var slugCaseFolder = cases.Fold()
+
+// normalizeSlug folds the case of a slug and normalizes it to NFC if the normalization is enabled
+func (a *app) normalizeSlug(slug string) string {
+	if !a.config().SlugNormalization {
+		return slug
+	}
+	return normalizedSlug(slug)
+}
+
+func normalizedSlug(slug string) string {
+	return norm.NFC.String(slugCaseFolder.String(norm.NFC.String(slug)))
+}
+
+// validateSlug rejects slugs that could be confused with other slugs if the normalization is enabled
+func (a *app) validateSlug(slug string) error {
+	if !a.config().SlugNormalization {
+		return nil
+	}
+	return checkConfusable(slug)
+}
+
+// checkConfusable rejects invisible characters, compatibility characters (like
+// fullwidth letters), slugs mixing scripts and slugs consisting only of
+// letters that look like Latin letters.
+func checkConfusable(slug string) error {
+	scripts := map[string]bool{}
+	onlyConfusable := true
+	for _, r := range slug {
+		if unicode.IsControl(r) || unicode.Is(unicode.Cf, r) || unicode.IsSpace(r) {
+			return fmt.Errorf("slug contains invisible character %U", r)
+		}
+		if s := string(r); norm.NFKC.String(s) != s {
+			return fmt.Errorf("slug contains compatibility character %q", r)
+		}
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		scripts[scriptOf(r)] = true
+		if !strings.ContainsRune(confusableLetters, unicode.ToLower(r)) {
+			onlyConfusable = false
+		}
+	}
+	if len(scripts) > 1 {
+		names := make([]string, 0, len(scripts))
+		for name := range scripts {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		return fmt.Errorf("slug mixes scripts (%s)", strings.Join(names, ", "))
+	}
+	if len(scripts) == 1 && onlyConfusable {
+		return errors.New("slug only consists of letters that look like Latin letters")
+	}
+	return nil
+}
+
+// scriptOf returns the name of the script of a letter, treating the scripts used for Japanese as one
+func scriptOf(r rune) string {
+	if unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana) {
+		return "Han"
+	}
+	for name, table := range unicode.Scripts {
+		if name != "Common" && name != "Inherited" && unicode.Is(table, r) {
+			return name
+		}
+	}
+	return "Unknown"
+}
+
+// migrateSlugNormalization renames existing slugs to their normalized form. If
+// slugs would conflict after normalization, they are reported and nothing is changed.
+func (a *app) migrateSlugNormalization(ctx context.Context) (err error) {
+	if !a.config().SlugNormalization {
+		return nil
+	}
+	a.write.Lock()
+	defer a.write.Unlock()
+
+	groups := map[string][]string{}
+	err = a.db.query(ctx, "SELECT slug FROM redirect UNION SELECT slug FROM alias ORDER BY slug", func(stmt resultRow) error {
+		slug := stmt.ColumnText(0)
+		groups[normalizedSlug(slug)] = append(groups[normalizedSlug(slug)], slug)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var conflicts []string
+	for normalized, slugs := range groups {
+		if len(slugs) > 1 {
+			conflicts = append(conflicts, fmt.Sprintf("%s (normalized %q)", strings.Join(slugs, ", "), normalized))
+		}
+	}
+	if len(conflicts) > 0 {
+		slices.Sort(conflicts)
+		for _, c := range conflicts {
+			log.Println("Conflicting slugs:", c)
+		}
+		return fmt.Errorf("%d groups of slugs conflict after normalization, rename or delete them before enabling slug normalization", len(conflicts))
+	}
+
+	defer a.cache.clear()
+	return a.db.transaction(ctx, func(tx storage) error {
+		for normalized, slugs := range groups {
+			if slugs[0] == normalized {
+				continue
+			}
+			if _, err := tx.exec(ctx, "UPDATE alias SET slug = ? WHERE slug = ?", normalized, slugs[0]); err != nil {
+				return err
+			}
+			if err := moveLink(ctx, tx, slugs[0], normalized); err != nil {
+				return err
+			}
+			log.Printf("Normalized slug %q to %q", slugs[0], normalized)
+		}
+		return nil
+	})
+}
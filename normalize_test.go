@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_checkConfusable(t *testing.T) {
+	for _, tc := range []struct {
+		slug  string
+		valid bool
+	}{
+		{"docs", true},
+		{"docs-2024", true},
+		{"привет", true},
+		{"日本語のリンク", true},
+		{"pаypal", false},     // Cyrillic а in Latin slug
+		{"раур", false},       // only Cyrillic letters looking like Latin ones
+		{"ｄｏｃｓ", false},       // fullwidth
+		{"do\u200bcs", false}, // zero width space
+		{"ﬁle", false},        // ligature
+		{"café", true},        // composed é
+		{"cafe\u0301", true},  // decomposed é, only a combining mark
+		{"doc s", false},      // whitespace
+	} {
+		err := checkConfusable(tc.slug)
+		if tc.valid {
+			assert.NoError(t, err, tc.slug)
+		} else {
+			assert.Error(t, err, tc.slug)
+		}
+	}
+}
+
+func TestSlugNormalization(t *testing.T) {
+	t.Run("Conflicting slugs prevent enabling the normalization", func(t *testing.T) {
+		app := testApp(t)
+		defer closeTestApp(t, app)
+
+		require.NoError(t, app.insertRedirect("Docs", "https://docs.example", typUrl))
+		require.NoError(t, app.insertRedirect("docs", "https://other.example", typUrl))
+
+		app.config().SlugNormalization = true
+		err := app.migrateSlugNormalization(context.Background())
+		assert.ErrorContains(t, err, "1 groups of slugs conflict")
+
+		// nothing was renamed
+		exists, err := app.slugExists("Docs")
+		require.NoError(t, err)
+		assert.True(t, exists)
+	})
+	t.Run("Slugs are normalized on creation and lookup", func(t *testing.T) {
+		app := testApp(t)
+		defer closeTestApp(t, app)
+		app.config().Password = "abc"
+
+		require.NoError(t, app.insertRedirect("Docs", "https://docs.example", typUrl))
+		require.NoError(t, app.insertRedirect("Cafe\u0301", "https://cafe.example", typUrl))
+
+		app.config().SlugNormalization = true
+		require.NoError(t, app.migrateSlugNormalization(context.Background()))
+
+		router := app.initRouter()
+		get := func(path string) *http.Response {
+			req := httptest.NewRequest("GET", "http://example.com"+path, nil)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			return w.Result()
+		}
+		post := func(path string, form url.Values) int {
+			form.Set("password", "abc")
+			req := httptest.NewRequest("POST", "http://example.com"+path, strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			return w.Result().StatusCode
+		}
+
+		assert.Equal(t, "https://docs.example", get("/docs").Header.Get("Location"))
+		assert.Equal(t, "https://docs.example", get("/DOCS").Header.Get("Location"))
+		assert.Equal(t, "https://cafe.example", get("/"+url.PathEscape("caf\u00e9")).Header.Get("Location"))
+		assert.Equal(t, "https://cafe.example", get("/"+url.PathEscape("CAFE\u0301")).Header.Get("Location"))
+
+		// creating a slug differing only in case isn't possible
+		assert.Equal(t, http.StatusBadRequest, post("/s", url.Values{"url": {"https://example.com"}, "slug": {"DOCS"}}))
+		assert.Equal(t, http.StatusBadRequest, post("/s", url.Values{"url": {"https://example.com"}, "slug": {"pаypal"}}))
+		assert.Equal(t, http.StatusCreated, post("/s", url.Values{"url": {"https://example.com"}, "slug": {"News"}}))
+		assert.Equal(t, "https://example.com", get("/news").Header.Get("Location"))
+
+		// other endpoints use the normalized slug too
+		assert.Equal(t, http.StatusAccepted, post("/u", url.Values{"slug": {"NEWS"}, "new": {"https://news.example"}}))
+		assert.Equal(t, "https://news.example", get("/News").Header.Get("Location"))
+	})
+}
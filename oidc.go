@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+type oidcConfig struct {
+	// URL of the identity provider like https://accounts.example.com, single sign-on is disabled if empty
+	Issuer       string `mapstructure:"issuer"`
+	ClientID     string `mapstructure:"clientId"`
+	ClientSecret string `mapstructure:"clientSecret" secret:"true"`
+	// Name of the identity provider on the login page
+	Name string `mapstructure:"name"`
+	// Scopes to request in addition to openid
+	Scopes []string `mapstructure:"scopes"`
+	// Claim of the ID token with the groups of the user
+	GroupsClaim string `mapstructure:"groupsClaim"`
+	// Users allowed to log in by verified email address or group, they get the user role
+	AllowedEmails []string `mapstructure:"allowedEmails"`
+	AllowedGroups []string `mapstructure:"allowedGroups"`
+	// Users allowed to log in with the admin role
+	AdminEmails []string `mapstructure:"adminEmails"`
+	AdminGroups []string `mapstructure:"adminGroups"`
+}
+
+const oidcCookie = "goshort_oidc"
+
+// oidcFlow is the state of a login between the redirect to the identity provider
+// and the callback, it is kept in a cookie
+type oidcFlow struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	Next     string `json:"next"`
+}
+
+// oidcProvider returns the provider, which is discovered on the first login
+func (a *app) oidcProvider(ctx context.Context) (*oidc.Provider, error) {
+	a.oidcMu.Lock()
+	defer a.oidcMu.Unlock()
+	if a.provider != nil {
+		return a.provider, nil
+	}
+	provider, err := oidc.NewProvider(oidc.ClientContext(ctx, &http.Client{Timeout: 10 * time.Second}), a.config().OIDC.Issuer)
+	if err != nil {
+		return nil, err
+	}
+	a.provider = provider
+	return provider, nil
+}
+
+func (a *app) oauth2Config(provider *oidc.Provider) *oauth2.Config {
+	cfg := a.config()
+	redirectURL, _ := url.JoinPath(cfg.ShortUrl, "oidc", "callback")
+	return &oauth2.Config{
+		ClientID:     cfg.OIDC.ClientID,
+		ClientSecret: cfg.OIDC.ClientSecret,
+		Endpoint:     provider.Endpoint(),
+		RedirectURL:  redirectURL,
+		Scopes:       append([]string{oidc.ScopeOpenID}, cfg.OIDC.Scopes...),
+	}
+}
+
+// oidcLoginHandler redirects to the identity provider with a new state, nonce and PKCE verifier
+func (a *app) oidcLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if a.config().OIDC.Issuer == "" {
+		http.NotFound(w, r)
+		return
+	}
+	provider, err := a.oidcProvider(r.Context())
+	if err != nil {
+		log.Println("Failed to discover the OIDC provider:", err.Error())
+		http.Error(w, "The identity provider is not available", http.StatusBadGateway)
+		return
+	}
+	flow := oidcFlow{State: rand.Text(), Nonce: rand.Text(), Verifier: oauth2.GenerateVerifier(), Next: localRedirectTarget(r.FormValue("next"))}
+	value, _ := json.Marshal(flow)
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcCookie,
+		Value:    base64.RawURLEncoding.EncodeToString(value),
+		Path:     "/oidc/",
+		MaxAge:   int((10 * time.Minute).Seconds()),
+		Secure:   r.TLS != nil || strings.HasPrefix(a.config().ShortUrl, "https://"),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, a.oauth2Config(provider).AuthCodeURL(flow.State, oidc.Nonce(flow.Nonce), oauth2.S256ChallengeOption(flow.Verifier)), http.StatusFound)
+}
+
+// oidcCallbackHandler finishes the login and creates a session for the user
+func (a *app) oidcCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	if a.config().OIDC.Issuer == "" {
+		http.NotFound(w, r)
+		return
+	}
+	var flow oidcFlow
+	if cookie, err := r.Cookie(oidcCookie); err == nil {
+		value, _ := base64.RawURLEncoding.DecodeString(cookie.Value)
+		_ = json.Unmarshal(value, &flow)
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcCookie, Path: "/oidc/", MaxAge: -1})
+	if flow.State == "" || r.FormValue("state") != flow.State {
+		a.renderLogin(w, http.StatusBadRequest, "", "The login expired, try again")
+		return
+	}
+	if e := r.FormValue("error"); e != "" {
+		a.renderLogin(w, http.StatusUnauthorized, flow.Next, "Login failed: "+strings.TrimSpace(e+" "+r.FormValue("error_description")))
+		return
+	}
+	u, err := a.oidcExchange(r.Context(), r.FormValue("code"), flow)
+	if err != nil {
+		log.Println("OIDC login failed:", err.Error())
+		status := http.StatusUnauthorized
+		if errors.Is(err, errOIDCNotAllowed) {
+			status = http.StatusForbidden
+		}
+		a.renderLogin(w, status, flow.Next, "Login failed: "+err.Error())
+		return
+	}
+	id, expires, err := a.createSession(r.Context(), u)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	a.setSessionCookie(w, r, id, expires)
+	http.Redirect(w, r, flow.Next, http.StatusSeeOther)
+}
+
+var errOIDCNotAllowed = errors.New("the user is not allowed to log in")
+
+// oidcExchange redeems the authorization code and maps the verified ID token onto a user
+func (a *app) oidcExchange(ctx context.Context, code string, flow oidcFlow) (user, error) {
+	provider, err := a.oidcProvider(ctx)
+	if err != nil {
+		return user{}, err
+	}
+	ctx = oidc.ClientContext(ctx, &http.Client{Timeout: 10 * time.Second})
+	token, err := a.oauth2Config(provider).Exchange(ctx, code, oauth2.VerifierOption(flow.Verifier))
+	if err != nil {
+		return user{}, err
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return user{}, errors.New("no ID token in the token response")
+	}
+	idToken, err := provider.Verifier(&oidc.Config{ClientID: a.config().OIDC.ClientID}).Verify(ctx, rawIDToken)
+	if err != nil {
+		return user{}, err
+	}
+	if idToken.Nonce != flow.Nonce {
+		return user{}, errors.New("the ID token has a wrong nonce")
+	}
+	var claims map[string]any
+	if err := idToken.Claims(&claims); err != nil {
+		return user{}, err
+	}
+	return a.oidcUser(claims)
+}
+
+// oidcUser maps the claims of an ID token onto a user with the role of the
+// configured emails and groups. Emails are only used if the provider marks them as verified.
+func (a *app) oidcUser(claims map[string]any) (user, error) {
+	cfg := a.config().OIDC
+	subject, _ := claims["sub"].(string)
+	email, _ := claims["email"].(string)
+	if verified, _ := claims["email_verified"].(bool); !verified {
+		email = ""
+	}
+	var groups []string
+	switch g := claims[cfg.GroupsClaim].(type) {
+	case string:
+		groups = []string{g}
+	case []any:
+		for _, group := range g {
+			if s, ok := group.(string); ok {
+				groups = append(groups, s)
+			}
+		}
+	}
+	matches := func(emails, allowedGroups []string) bool {
+		if email != "" && slices.ContainsFunc(emails, func(e string) bool { return strings.EqualFold(e, email) }) {
+			return true
+		}
+		return slices.ContainsFunc(groups, func(g string) bool { return slices.Contains(allowedGroups, g) })
+	}
+	u := user{name: email}
+	if u.name == "" {
+		u.name = subject
+	}
+	switch {
+	case matches(cfg.AdminEmails, cfg.AdminGroups):
+		u.role = roleAdmin
+	case matches(cfg.AllowedEmails, cfg.AllowedGroups):
+		u.role = roleUser
+	default:
+		return user{}, errOIDCNotAllowed
+	}
+	return u, nil
+}
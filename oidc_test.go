@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mockOIDCProvider is a minimal OpenID Connect provider that logs in every
+// authorization request with the configured claims
+type mockOIDCProvider struct {
+	*httptest.Server
+	t        *testing.T
+	key      *rsa.PrivateKey
+	clientID string
+	secret   string
+
+	mu     sync.Mutex
+	claims map[string]any
+	codes  map[string]url.Values
+}
+
+func newMockOIDCProvider(t *testing.T) *mockOIDCProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	p := &mockOIDCProvider{t: t, key: key, clientID: "goshort", secret: "client-secret", codes: map[string]url.Values{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, _ *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"issuer":                                p.URL,
+			"authorization_endpoint":                p.URL + "/authorize",
+			"token_endpoint":                        p.URL + "/token",
+			"jwks_uri":                              p.URL + "/jwks",
+			"response_types_supported":              []string{"code"},
+			"subject_types_supported":               []string{"public"},
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+			"code_challenge_methods_supported":      []string{"S256"},
+		})
+	})
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, _ *http.Request) {
+		_ = json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{Key: &key.PublicKey, KeyID: "test", Algorithm: "RS256", Use: "sig"}}})
+	})
+	mux.HandleFunc("GET /authorize", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("client_id") != p.clientID || q.Get("response_type") != "code" || q.Get("code_challenge_method") != "S256" || !strings.Contains(q.Get("scope"), "openid") {
+			http.Error(w, "invalid authorization request", http.StatusBadRequest)
+			return
+		}
+		code := rand.Text()
+		p.mu.Lock()
+		p.codes[code] = q
+		p.mu.Unlock()
+		http.Redirect(w, r, q.Get("redirect_uri")+"?"+url.Values{"code": {code}, "state": {q.Get("state")}}.Encode(), http.StatusFound)
+	})
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		if id, secret, ok := r.BasicAuth(); !ok || id != p.clientID || secret != p.secret {
+			http.Error(w, `{"error":"invalid_client"}`, http.StatusUnauthorized)
+			return
+		}
+		p.mu.Lock()
+		auth, ok := p.codes[r.PostFormValue("code")]
+		delete(p.codes, r.PostFormValue("code"))
+		claims := p.claims
+		p.mu.Unlock()
+		challenge := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+		if !ok || auth.Get("redirect_uri") != r.PostFormValue("redirect_uri") || base64.RawURLEncoding.EncodeToString(challenge[:]) != auth.Get("code_challenge") {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     p.idToken(auth.Get("nonce"), claims),
+		})
+	})
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+	return p
+}
+
+func (p *mockOIDCProvider) idToken(nonce string, claims map[string]any) string {
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: p.key}, (&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", "test"))
+	require.NoError(p.t, err)
+	token, err := jwt.Signed(signer).Claims(jwt.Claims{
+		Issuer:   p.URL,
+		Audience: jwt.Audience{p.clientID},
+		Expiry:   jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		IssuedAt: jwt.NewNumericDate(time.Now()),
+	}).Claims(map[string]any{"nonce": nonce}).Claims(claims).Serialize()
+	require.NoError(p.t, err)
+	return token
+}
+
+func TestOIDC(t *testing.T) {
+	provider := newMockOIDCProvider(t)
+	app := testApp(t)
+	defer closeTestApp(t, app)
+	app.config().Password = ""
+	app.config().ShortUrl = "https://short.example"
+	app.config().DefaultUrl = "https://default.example"
+	app.config().OIDC = oidcConfig{
+		Issuer:        provider.URL,
+		ClientID:      provider.clientID,
+		ClientSecret:  provider.secret,
+		Name:          "Example ID",
+		Scopes:        []string{"email", "groups"},
+		GroupsClaim:   "groups",
+		AllowedGroups: []string{"staff"},
+		AdminEmails:   []string{"admin@example.com"},
+	}
+	require.NoError(t, validateConfig(app.config()))
+	router := app.initRouter()
+	noRedirects := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+
+	get := func(path string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://example.com"+path, nil)
+		req.Header.Set("Accept", "text/html")
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	// login goes through the flow and returns the response of the callback
+	login := func(claims map[string]any) *httptest.ResponseRecorder {
+		provider.mu.Lock()
+		provider.claims = claims
+		provider.mu.Unlock()
+
+		w := get("/oidc/login?next=%2Fl")
+		require.Equal(t, http.StatusFound, w.Code)
+		require.Len(t, w.Result().Cookies(), 1)
+		flowCookie := w.Result().Cookies()[0]
+		authorize := w.Header().Get("Location")
+		require.True(t, strings.HasPrefix(authorize, provider.URL+"/authorize?"), authorize)
+
+		res, err := noRedirects.Get(authorize)
+		require.NoError(t, err)
+		_ = res.Body.Close()
+		require.Equal(t, http.StatusFound, res.StatusCode)
+		callback, err := url.Parse(res.Header.Get("Location"))
+		require.NoError(t, err)
+		require.Equal(t, "https://short.example/oidc/callback", callback.Scheme+"://"+callback.Host+callback.Path)
+		return get("/oidc/callback?"+callback.RawQuery, flowCookie)
+	}
+	sessionCookieOf := func(w *httptest.ResponseRecorder) *http.Cookie {
+		for _, c := range w.Result().Cookies() {
+			if c.Name == sessionCookie {
+				return c
+			}
+		}
+		return nil
+	}
+
+	t.Run("The login page offers single sign-on", func(t *testing.T) {
+		w := get("/l")
+		assert.Equal(t, http.StatusSeeOther, w.Code)
+		w = get("/login?next=%2Fl")
+		assert.Contains(t, w.Body.String(), `href="/oidc/login?next=%2fl">Log in with Example ID</a>`)
+		// without a password there is no password form
+		assert.NotContains(t, w.Body.String(), "name=password")
+	})
+	t.Run("Admins by email", func(t *testing.T) {
+		w := login(map[string]any{"sub": "1", "email": "Admin@example.com", "email_verified": true})
+		require.Equal(t, http.StatusSeeOther, w.Code, w.Body.String())
+		assert.Equal(t, "/l", w.Header().Get("Location"))
+		cookie := sessionCookieOf(w)
+		require.NotNil(t, cookie)
+		assert.Equal(t, http.StatusOK, get("/l", cookie).Code)
+		assert.Equal(t, http.StatusOK, get("/metrics", cookie).Code)
+	})
+	t.Run("Users by group", func(t *testing.T) {
+		w := login(map[string]any{"sub": "2", "email": "user@example.com", "email_verified": true, "groups": []string{"other", "staff"}})
+		require.Equal(t, http.StatusSeeOther, w.Code, w.Body.String())
+		cookie := sessionCookieOf(w)
+		require.NotNil(t, cookie)
+
+		var username, role string
+		require.NoError(t, app.db.query(context.Background(), "SELECT username, role FROM session WHERE id = ?", func(stmt resultRow) error {
+			username, role = stmt.ColumnText(0), stmt.ColumnText(1)
+			return nil
+		}, hashSessionID(cookie.Value)))
+		assert.Equal(t, "user@example.com", username)
+		assert.Equal(t, roleUser, role)
+
+		// users can manage links, but not use the maintenance routes
+		w = get("/s", cookie)
+		assert.Equal(t, http.StatusOK, w.Code)
+		match := regexp.MustCompile(`name=csrf value="([^"]+)"`).FindStringSubmatch(w.Body.String())
+		require.Len(t, match, 2)
+		req := httptest.NewRequest("POST", "http://example.com/s", strings.NewReader(url.Values{"url": {"https://sso.example"}, "csrf": {match[1]}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(cookie)
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusCreated, w.Code)
+		assert.Equal(t, http.StatusForbidden, get("/metrics", cookie).Code)
+		assert.Equal(t, http.StatusForbidden, get("/backup", cookie).Code)
+	})
+	t.Run("Other users are rejected", func(t *testing.T) {
+		// unverified emails aren't trusted
+		w := login(map[string]any{"sub": "3", "email": "admin@example.com", "email_verified": false})
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		assert.Contains(t, w.Body.String(), "not allowed")
+		assert.Nil(t, sessionCookieOf(w))
+
+		// neither are emails without the claim
+		w = login(map[string]any{"sub": "5", "email": "admin@example.com"})
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		assert.Nil(t, sessionCookieOf(w))
+
+		w = login(map[string]any{"sub": "4", "email": "other@example.com", "email_verified": true, "groups": "guests"})
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		assert.Nil(t, sessionCookieOf(w))
+	})
+	t.Run("Callbacks of other logins are rejected", func(t *testing.T) {
+		w := get("/oidc/callback?code=abc&state=def")
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+
+		w = get("/oidc/login")
+		flowCookie := w.Result().Cookies()[0]
+		w = get("/oidc/callback?code=abc&state=wrong", flowCookie)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Nil(t, sessionCookieOf(w))
+	})
+	t.Run("Invalid configs", func(t *testing.T) {
+		cfg := &config{ShortUrl: "https://short.example", DefaultUrl: "https://default.example"}
+		assert.ErrorContains(t, validateConfig(cfg), "no password")
+		cfg.OIDC.Issuer = provider.URL
+		assert.ErrorContains(t, validateConfig(cfg), "client ID")
+		cfg.OIDC.ClientID = "goshort"
+		assert.ErrorContains(t, validateConfig(cfg), "no users are allowed")
+		cfg.OIDC.AllowedEmails = []string{"user@example.com"}
+		assert.NoError(t, validateConfig(cfg))
+	})
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	_ "embed"
+	"html/template"
+	"net/http"
+)
+
+// openAPISpec describes all routes of initRouter, openapi_test.go makes sure it stays complete
+//
+//go:embed static/openapi.json
+var openAPISpec []byte
+
+func openAPIHandler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(openAPISpec)
+}
+
+func docsHandler(w http.ResponseWriter, _ *http.Request) {
+	if err := docsTemplate.Execute(w, &templateData{Style: template.CSS(styleCSS)}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
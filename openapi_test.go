@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testOpenAPIParameter struct {
+	Name string `json:"name"`
+	In   string `json:"in"`
+}
+
+type testOpenAPIOperation struct {
+	Security   []map[string][]string  `json:"security"`
+	Parameters []testOpenAPIParameter `json:"parameters"`
+	Responses  map[string]any         `json:"responses"`
+}
+
+func TestOpenAPI(t *testing.T) {
+	var spec struct {
+		OpenAPI string                                     `json:"openapi"`
+		Paths   map[string]map[string]testOpenAPIOperation `json:"paths"`
+	}
+	require.NoError(t, json.Unmarshal(openAPISpec, &spec))
+	assert.True(t, strings.HasPrefix(spec.OpenAPI, "3."))
+
+	t.Run("Every route is documented", func(t *testing.T) {
+		app := testApp(t)
+		defer closeTestApp(t, app)
+		var routes, documented []string
+		err := chi.Walk(app.initRouter(), func(method, route string, _ http.Handler, _ ...func(http.Handler) http.Handler) error {
+			routes = append(routes, method+" "+route)
+			return nil
+		})
+		require.NoError(t, err)
+		for path, operations := range spec.Paths {
+			for method := range operations {
+				documented = append(documented, strings.ToUpper(method)+" "+path)
+			}
+		}
+		slices.Sort(routes)
+		slices.Sort(documented)
+		assert.Equal(t, routes, documented)
+	})
+	t.Run("Operations are complete", func(t *testing.T) {
+		for path, operations := range spec.Paths {
+			for method, op := range operations {
+				name := strings.ToUpper(method) + " " + path
+				assert.NotEmpty(t, op.Responses, name)
+				// authenticated operations inherit the global security
+				if op.Security == nil {
+					assert.Contains(t, op.Responses, "401", name)
+				}
+				for _, segment := range strings.Split(path, "/") {
+					if param, ok := strings.CutPrefix(segment, "{"); ok {
+						assert.True(t, slices.ContainsFunc(op.Parameters, func(p testOpenAPIParameter) bool {
+							return p.In == "path" && p.Name == strings.TrimSuffix(param, "}")
+						}), name)
+					}
+				}
+			}
+		}
+	})
+	t.Run("Serve the document and the documentation", func(t *testing.T) {
+		app := testApp(t)
+		defer closeTestApp(t, app)
+		app.config().Password = "abc"
+		router := app.initRouter()
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/openapi.json", nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+		assert.True(t, json.Valid(w.Body.Bytes()))
+
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/openapi", nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), "fetch('/openapi.json')")
+	})
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+type policyConfig struct {
+	// Allowed URL schemes, http and https if empty
+	Schemes []string `mapstructure:"schemes"`
+	// If set, only destinations on these domains are allowed
+	AllowDomains []string `mapstructure:"allowDomains"`
+	// Destinations on these domains are rejected
+	DenyDomains []string `mapstructure:"denyDomains"`
+	// File with blocked domains (one per line), reloaded on change
+	BlocklistFile string `mapstructure:"blocklistFile"`
+}
+
+type blocklist struct {
+	mu          sync.RWMutex
+	domains     map[string]bool
+	stopWatcher func()
+}
+
+// blocks reports whether the host or one of its parent domains is on the blocklist
+func (b *blocklist) blocks(host string) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for host != "" {
+		if b.domains[host] {
+			return true
+		}
+		_, host, _ = strings.Cut(host, ".")
+	}
+	return false
+}
+
+func (b *blocklist) set(domains map[string]bool) {
+	b.mu.Lock()
+	b.domains = domains
+	b.mu.Unlock()
+}
+
+// checkLink rejects unknown link types and checks the destination of every
+// type but text against the policy.
+func (a *app) checkLink(typ, destination string) error {
+	switch typ {
+	case typText:
+		return nil
+	case typUrl:
+		return a.checkDestination(destination)
+	}
+	return fmt.Errorf("unknown type %q, use %q or %q", typ, typUrl, typText)
+}
+
+// checkDestination checks a destination URL against the configured policy and
+// returns an error describing why it is rejected.
+func (a *app) checkDestination(destination string) error {
+	u, err := url.Parse(destination)
+	if err != nil {
+		return errors.New("destination rejected: invalid URL")
+	}
+	cfg := a.config().Policy
+	schemes := cfg.Schemes
+	if len(schemes) == 0 {
+		schemes = []string{"http", "https"}
+	}
+	if !containsFold(schemes, u.Scheme) {
+		return fmt.Errorf("destination rejected: scheme %q is not allowed", u.Scheme)
+	}
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	if host == "" {
+		if u.Scheme == "http" || u.Scheme == "https" {
+			return errors.New("destination rejected: missing host")
+		}
+		// Schemes like mailto have no host to check
+		return nil
+	}
+	if len(cfg.AllowDomains) > 0 && !matchDomains(cfg.AllowDomains, host) {
+		return fmt.Errorf("destination rejected: domain %q is not on the allowlist", host)
+	}
+	if matchDomains(cfg.DenyDomains, host) {
+		return fmt.Errorf("destination rejected: domain %q is on the denylist", host)
+	}
+	if a.blocklist.blocks(host) {
+		return fmt.Errorf("destination rejected: domain %q is on the blocklist", host)
+	}
+	return nil
+}
+
+func containsFold(list []string, s string) bool {
+	for _, e := range list {
+		if strings.EqualFold(e, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchDomains reports whether the host matches one of the patterns. A pattern
+// is either a domain matching exactly, "*.domain" matching all subdomains or "*".
+func matchDomains(patterns []string, host string) bool {
+	for _, p := range patterns {
+		p = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(p)), ".")
+		switch {
+		case p == "*":
+			return true
+		case strings.HasPrefix(p, "*."):
+			if strings.HasSuffix(host, p[1:]) {
+				return true
+			}
+		case p == host:
+			return true
+		}
+	}
+	return false
+}
+
+// loadBlocklist reads a blocklist file. Lines can be plain domains or hosts
+// file entries, comments start with #. An empty path clears the blocklist.
+func (a *app) loadBlocklist(path string) error {
+	if path == "" {
+		a.blocklist.set(nil)
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	domains := map[string]bool{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		domain := strings.TrimSuffix(strings.ToLower(fields[len(fields)-1]), ".")
+		domains[domain] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	a.blocklist.set(domains)
+	log.Println("Loaded", len(domains), "domains from the blocklist")
+	return nil
+}
+
+// watchBlocklist reloads the blocklist file whenever it changes, replacing a
+// previous watcher.
+func (a *app) watchBlocklist(path string) error {
+	if path == "" {
+		a.blocklist.setWatcher(nil)
+		return nil
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	// Watch the directory, so atomic replacements of the file are noticed as well
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		_ = watcher.Close()
+		return err
+	}
+	var wg sync.WaitGroup
+	wg.Go(func() {
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) != filepath.Clean(path) || !event.Has(fsnotify.Write|fsnotify.Create) {
+					continue
+				}
+				if err := a.loadBlocklist(path); err != nil {
+					log.Println("Failed to reload blocklist:", err.Error())
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Println("Blocklist watcher error:", err.Error())
+			}
+		}
+	})
+	a.blocklist.setWatcher(func() {
+		_ = watcher.Close()
+		wg.Wait()
+	})
+	return nil
+}
+
+// setWatcher replaces the function stopping the file watcher and stops the previous watcher
+func (b *blocklist) setWatcher(stop func()) {
+	b.mu.Lock()
+	previous := b.stopWatcher
+	b.stopWatcher = stop
+	b.mu.Unlock()
+	// Outside of the lock, the watcher might be loading the blocklist
+	if previous != nil {
+		previous()
+	}
+}
+
+// initPolicy loads the blocklist and starts watching it for changes.
+func (a *app) initPolicy() error {
+	a.shutdown.Add(func() {
+		a.blocklist.setWatcher(nil)
+	})
+	path := a.config().Policy.BlocklistFile
+	if err := a.loadBlocklist(path); err != nil {
+		return err
+	}
+	return a.watchBlocklist(path)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_checkDestination(t *testing.T) {
+	app := newApp(&config{Policy: policyConfig{
+		AllowDomains: []string{"example.com", "*.example.com", "*.example.org"},
+		DenyDomains:  []string{"bad.example.com"},
+	}})
+	app.blocklist.set(map[string]bool{"blocked.example.org": true})
+
+	for _, tc := range []struct {
+		url     string
+		allowed bool
+	}{
+		{"https://example.com/test", true},
+		{"http://sub.example.com", true},
+		{"https://EXAMPLE.com.", true},
+		{"https://example.org", false},
+		{"https://www.example.org", true},
+		{"https://example.net", false},
+		{"https://bad.example.com", false},
+		{"https://blocked.example.org", false},
+		{"https://sub.blocked.example.org", false},
+		{"javascript:alert(1)", false},
+		{"JavaScript:alert(1)", false},
+		{"data:text/html,hello", false},
+		{"ftp://example.com", false},
+		{"https://", false},
+		{"/relative", false},
+	} {
+		err := app.checkDestination(tc.url)
+		if tc.allowed {
+			assert.NoError(t, err, tc.url)
+		} else {
+			assert.Error(t, err, tc.url)
+		}
+	}
+
+	app.config().Policy = policyConfig{Schemes: []string{"https", "mailto"}}
+	assert.NoError(t, app.checkDestination("mailto:test@example.com"))
+	assert.NoError(t, app.checkDestination("https://example.net"))
+	assert.ErrorContains(t, app.checkDestination("http://example.net"), "scheme \"http\" is not allowed")
+}
+
+func TestPolicyEnforcement(t *testing.T) {
+	t.Run("Create and update reject disallowed destinations", func(t *testing.T) {
+		blocklistFile := filepath.Join(t.TempDir(), "blocklist.txt")
+		require.NoError(t, os.WriteFile(blocklistFile, []byte("# comment\nblocked.example.com\n0.0.0.0 hosts.example.com\n"), 0o644))
+
+		app := testApp(t)
+		defer closeTestApp(t, app)
+		app.config().Password = "abc"
+		app.config().Policy.BlocklistFile = blocklistFile
+		require.NoError(t, app.initPolicy())
+
+		router := app.initRouter()
+		post := func(path string, form url.Values) (int, string) {
+			form.Set("password", "abc")
+			req := httptest.NewRequest("POST", "http://example.com"+path, strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			return w.Result().StatusCode, w.Body.String()
+		}
+
+		code, body := post("/s", url.Values{"url": {"javascript:alert(1)"}})
+		assert.Equal(t, http.StatusBadRequest, code)
+		assert.Contains(t, body, "scheme \"javascript\" is not allowed")
+
+		code, body = post("/s", url.Values{"url": {"https://blocked.example.com/page"}})
+		assert.Equal(t, http.StatusBadRequest, code)
+		assert.Contains(t, body, "is on the blocklist")
+
+		code, _ = post("/s", url.Values{"url": {"https://hosts.example.com/page"}})
+		assert.Equal(t, http.StatusBadRequest, code)
+
+		code, _ = post("/u", url.Values{"slug": {"source"}, "new": {"data:text/html,hi"}})
+		assert.Equal(t, http.StatusBadRequest, code)
+
+		// unknown types would be redirects as well, so they are rejected
+		code, body = post("/u", url.Values{"slug": {"source"}, "type": {"redirect"}, "new": {"https://blocked.example.com/page"}})
+		assert.Equal(t, http.StatusBadRequest, code)
+		assert.Contains(t, body, "unknown type")
+		_, err := app.db.exec(context.Background(), "INSERT INTO revision (slug, url, type, created) VALUES ('source', 'https://blocked.example.com/page', 'redirect', unixepoch())")
+		require.NoError(t, err)
+		var revision int64
+		require.NoError(t, app.db.query(context.Background(), "SELECT id FROM revision WHERE type = 'redirect'", func(stmt resultRow) error {
+			revision = stmt.ColumnInt64(0)
+			return nil
+		}))
+		code, body = post("/r", url.Values{"slug": {"source"}, "revision": {strconv.FormatInt(revision, 10)}})
+		assert.Equal(t, http.StatusBadRequest, code)
+		assert.Contains(t, body, "unknown type")
+
+		// texts aren't URLs and therefore not checked
+		code, _ = post("/u", url.Values{"slug": {"source"}, "type": {"text"}, "new": {"javascript:alert(1)"}})
+		assert.Equal(t, http.StatusAccepted, code)
+
+		code, _ = post("/s", url.Values{"url": {"https://fine.example.com"}})
+		assert.Equal(t, http.StatusCreated, code)
+
+		// the blocklist is reloaded when the file changes
+		require.NoError(t, os.WriteFile(blocklistFile, []byte("fine.example.com\n"), 0o644))
+		assert.Eventually(t, func() bool {
+			return app.checkDestination("https://fine.example.com") != nil && app.checkDestination("https://blocked.example.com") == nil
+		}, 5*time.Second, 50*time.Millisecond)
+	})
+}
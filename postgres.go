@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// postgresStorage stores the data in PostgreSQL, so multiple instances can share a database
+type postgresStorage struct {
+	pool *pgxpool.Pool
+	// set for transactions
+	tx pgx.Tx
+}
+
+// Key for the advisory lock held while migrating, so only one instance migrates at a time
+const postgresMigrationLock = 0x1bd6d04a
+
+// Migrations for PostgreSQL, the schema matches the SQLite schema
+var postgresMigrations = []string{
+	`
+	create or replace function unixepoch() returns bigint language sql stable as $$ select extract(epoch from now())::bigint $$;
+	create or replace function group_concat_step(acc text, value text, separator text) returns text language sql immutable as $$
+		select case when value is null then acc when acc is null then value else acc || separator || value end
+	$$;
+	create or replace aggregate group_concat(text, text) (sfunc = group_concat_step, stype = text);
+	create table if not exists redirect(slug text not null primary key, url text not null, type text not null default 'url', hits bigint default 0 not null, created bigint, deleted bigint, check_status integer, check_latency bigint, check_error text, check_time bigint);
+	insert into redirect (slug, url, created) values ('source', 'https://github.com/jlelse/GoShort', unixepoch()) on conflict do nothing;
+	create table if not exists revision(id bigserial primary key, slug text not null, url text not null, type text not null, created bigint not null);
+	create index if not exists revision_slug on revision(slug);
+	create table if not exists counter(name text not null primary key, value bigint not null);
+	create table if not exists alias(slug text not null primary key, link text not null);
+	create index if not exists alias_link on alias(link);
+	`,
+	`
+	create table if not exists click(slug text not null, created bigint not null, visitor text not null, referrer text not null);
+	create index if not exists click_slug_created on click(slug, created);
+	create index if not exists click_created on click(created);
+	create table if not exists click_daily(slug text not null, day bigint not null, clicks bigint not null, visitors bigint not null, primary key (slug, day));
+	create table if not exists click_referrer(slug text not null, day bigint not null, referrer text not null, clicks bigint not null, primary key (slug, day, referrer));
+	`,
+	`
+	create table if not exists session(id text not null primary key, created bigint not null, expires bigint not null);
+	create index if not exists session_expires on session(expires);
+	`,
+	`
+	alter table session add column username text not null default '';
+	alter table session add column role text not null default 'admin';
+	`,
+	`
+	create table if not exists visitor_salt(day bigint not null primary key, salt text not null);
+	`,
+}
+
+func openPostgres(ctx context.Context, url string) (*postgresStorage, error) {
+	pool, err := pgxpool.New(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	if err := pool.Ping(ctx); err != nil {
+		pool.Close()
+		return nil, err
+	}
+	return &postgresStorage{pool: pool}, nil
+}
+
+type postgresQuerier interface {
+	Exec(ctx context.Context, sql string, arguments ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+}
+
+func (s *postgresStorage) querier() postgresQuerier {
+	if s.tx != nil {
+		return s.tx
+	}
+	return s.pool
+}
+
+func (s *postgresStorage) exec(ctx context.Context, query string, args ...any) (int, error) {
+	tag, err := s.querier().Exec(ctx, rebind(query), args...)
+	if err != nil {
+		return 0, err
+	}
+	return int(tag.RowsAffected()), nil
+}
+
+func (s *postgresStorage) query(ctx context.Context, query string, resultFunc func(stmt resultRow) error, args ...any) error {
+	rows, err := s.querier().Query(ctx, rebind(query), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		values, err := rows.Values()
+		if err != nil {
+			return err
+		}
+		if err := resultFunc(postgresRow(values)); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (s *postgresStorage) transaction(ctx context.Context, fn func(tx storage) error) (err error) {
+	var tx pgx.Tx
+	if s.tx != nil {
+		// Nested transactions are savepoints
+		tx, err = s.tx.Begin(ctx)
+	} else {
+		tx, err = s.pool.Begin(ctx)
+	}
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback(ctx)
+		}
+	}()
+	if err = fn(&postgresStorage{pool: s.pool, tx: tx}); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+func (s *postgresStorage) close() error {
+	s.pool.Close()
+	return nil
+}
+
+func (s *postgresStorage) insertLink(ctx context.Context, slug, url, typ string) error {
+	_, err := s.exec(ctx, "INSERT INTO redirect (slug, url, type, created) VALUES (?, ?, ?, unixepoch())", slug, url, typ)
+	return err
+}
+
+func (s *postgresStorage) findLink(ctx context.Context, url, typ string) (slug string, err error) {
+	err = s.query(ctx, "SELECT slug FROM redirect WHERE url = ? AND type = ? AND deleted IS NULL LIMIT 1", func(stmt resultRow) error {
+		slug = stmt.ColumnText(0)
+		return nil
+	}, url, typ)
+	return
+}
+
+func (s *postgresStorage) resolveLink(ctx context.Context, slug string) (*storedLink, error) {
+	link := &storedLink{}
+	err := s.query(ctx, "SELECT "+linkColumns+" FROM redirect WHERE slug = coalesce((SELECT link FROM alias WHERE slug = ?), ?) AND deleted IS NULL", func(stmt resultRow) error {
+		link = scanLink(stmt, false)
+		return nil
+	}, slug, slug)
+	return link, err
+}
+
+func (s *postgresStorage) listLinks(ctx context.Context, order linkOrder, desc bool) (links []*storedLink, err error) {
+	err = s.query(ctx, "SELECT "+linkColumns+", (SELECT string_agg(alias.slug, ', ' ORDER BY alias.slug) FROM alias WHERE alias.link = redirect.slug) FROM redirect WHERE deleted IS NULL ORDER BY "+order.orderBy(desc), func(stmt resultRow) error {
+		links = append(links, scanLink(stmt, true))
+		return nil
+	})
+	return
+}
+
+func (s *postgresStorage) brokenLinks(ctx context.Context) (links []*storedLink, err error) {
+	err = s.query(ctx, "SELECT "+linkColumns+" FROM redirect WHERE type = 'url' AND deleted IS NULL AND (check_error != '' OR check_status >= 400) ORDER BY check_time DESC", func(stmt resultRow) error {
+		links = append(links, scanLink(stmt, false))
+		return nil
+	})
+	return
+}
+
+func (s *postgresStorage) saveCheckResult(ctx context.Context, slug string, res *checkResult) error {
+	_, err := s.exec(ctx, "UPDATE redirect SET check_status = ?, check_latency = ?, check_error = ?, check_time = unixepoch() WHERE slug = ?", res.Status, res.Latency.Milliseconds(), res.Error, slug)
+	return err
+}
+
+func (s *postgresStorage) recordClicks(ctx context.Context, clicks []click) error {
+	return s.transaction(ctx, func(tx storage) error {
+		// All statements are sent at once instead of waiting for each of them
+		batch := &pgx.Batch{}
+		for _, c := range clicks {
+			batch.Queue("INSERT INTO click (slug, created, visitor, referrer) VALUES ($1, $2, $3, $4)", c.slug, c.time, c.visitor, c.referrer)
+		}
+		slugs, counts := clickCounts(clicks)
+		for _, slug := range slugs {
+			batch.Queue("UPDATE redirect SET hits = hits + $1 WHERE slug = $2", counts[slug], slug)
+		}
+		return tx.(*postgresStorage).tx.SendBatch(ctx, batch).Close()
+	})
+}
+
+func (s *postgresStorage) rollupClicks(ctx context.Context, beforeDay int64, topReferrers int) (rolledUp int, err error) {
+	before := beforeDay * secondsPerDay
+	err = s.transaction(ctx, func(tx storage) error {
+		_, err := tx.exec(ctx, `INSERT INTO click_daily (slug, day, clicks, visitors)
+			SELECT slug, created / 86400, count(*), count(DISTINCT visitor) FROM click WHERE created < ? GROUP BY slug, created / 86400
+			ON CONFLICT (slug, day) DO UPDATE SET clicks = click_daily.clicks + excluded.clicks, visitors = click_daily.visitors + excluded.visitors`, before)
+		if err != nil {
+			return err
+		}
+		_, err = tx.exec(ctx, `INSERT INTO click_referrer (slug, day, referrer, clicks)
+			SELECT slug, day, referrer, clicks FROM (
+				SELECT slug, created / 86400 AS day, referrer, count(*) AS clicks, row_number() OVER (PARTITION BY slug, created / 86400 ORDER BY count(*) DESC, referrer) AS n
+				FROM click WHERE created < ? AND referrer != '' GROUP BY slug, created / 86400, referrer
+			) AS ranked WHERE n <= ?
+			ON CONFLICT (slug, day, referrer) DO UPDATE SET clicks = click_referrer.clicks + excluded.clicks`, before, topReferrers)
+		if err != nil {
+			return err
+		}
+		rolledUp, err = tx.exec(ctx, "DELETE FROM click WHERE created < ?", before)
+		return err
+	})
+	return
+}
+
+func (s *postgresStorage) dailyClicks(ctx context.Context, slug string, fromDay int64) (days []dayClicks, err error) {
+	// Days that are rolled up already and days with single clicks are combined,
+	// sums of bigint columns are numeric in PostgreSQL
+	err = s.query(ctx, `SELECT day, sum(clicks)::bigint, sum(visitors)::bigint FROM (
+			SELECT day, clicks, visitors FROM click_daily WHERE slug = ? AND day >= ?
+			UNION ALL
+			SELECT created / 86400 AS day, count(*) AS clicks, count(DISTINCT visitor) AS visitors FROM click WHERE slug = ? AND created >= ? GROUP BY created / 86400
+		) AS days GROUP BY day ORDER BY day DESC`, func(stmt resultRow) error {
+		days = append(days, dayClicks{day: stmt.ColumnInt64(0), clicks: stmt.ColumnInt64(1), visitors: stmt.ColumnInt64(2)})
+		return nil
+	}, slug, fromDay, slug, fromDay*secondsPerDay)
+	return
+}
+
+func (s *postgresStorage) topReferrers(ctx context.Context, slug string, fromDay int64, limit int) (referrers []referrerClicks, err error) {
+	err = s.query(ctx, `SELECT referrer, sum(clicks)::bigint AS total FROM (
+			SELECT referrer, clicks FROM click_referrer WHERE slug = ? AND day >= ?
+			UNION ALL
+			SELECT referrer, count(*) AS clicks FROM click WHERE slug = ? AND created >= ? AND referrer != '' GROUP BY referrer
+		) AS refs GROUP BY referrer ORDER BY total DESC, referrer LIMIT ?`, func(stmt resultRow) error {
+		referrers = append(referrers, referrerClicks{host: stmt.ColumnText(0), clicks: stmt.ColumnInt64(1)})
+		return nil
+	}, slug, fromDay, slug, fromDay*secondsPerDay, limit)
+	return
+}
+
+func (s *postgresStorage) migrate(ctx context.Context) error {
+	return s.transaction(ctx, func(tx storage) error {
+		if _, err := tx.exec(ctx, "SELECT pg_advisory_xact_lock(?)", int64(postgresMigrationLock)); err != nil {
+			return err
+		}
+		if _, err := tx.exec(ctx, "CREATE TABLE IF NOT EXISTS schema_version(version integer not null)"); err != nil {
+			return err
+		}
+		version := 0
+		err := tx.query(ctx, "SELECT version FROM schema_version", func(stmt resultRow) error {
+			version = stmt.ColumnInt(0)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if version > len(postgresMigrations) {
+			return fmt.Errorf("database schema version %d is newer than supported", version)
+		}
+		for i, migration := range postgresMigrations[version:] {
+			// Without arguments multiple statements can be executed at once
+			if _, err := tx.exec(ctx, migration); err != nil {
+				return fmt.Errorf("migration %d: %w", version+i+1, err)
+			}
+		}
+		if _, err := tx.exec(ctx, "DELETE FROM schema_version"); err != nil {
+			return err
+		}
+		_, err = tx.exec(ctx, "INSERT INTO schema_version (version) VALUES (?)", len(postgresMigrations))
+		return err
+	})
+}
+
+// rebind replaces ? placeholders outside of string literals with $1, $2, …
+func rebind(query string) string {
+	var b strings.Builder
+	n, quoted := 0, false
+	for _, c := range query {
+		switch {
+		case c == '\'':
+			quoted = !quoted
+		case c == '?' && !quoted:
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// postgresRow converts the values of a row like SQLite does
+type postgresRow []any
+
+func (r postgresRow) ColumnText(col int) string {
+	switch v := r[col].(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func (r postgresRow) ColumnInt(col int) int {
+	return int(r.ColumnInt64(col))
+}
+
+func (r postgresRow) ColumnBool(col int) bool {
+	return r.ColumnInt64(col) != 0
+}
+
+func (r postgresRow) ColumnInt64(col int) int64 {
+	switch v := r[col].(type) {
+	case int64:
+		return v
+	case int32:
+		return int64(v)
+	case int16:
+		return int64(v)
+	case float64:
+		return int64(v)
+	case bool:
+		if v {
+			return 1
+		}
+		return 0
+	case string:
+		n, _ := strconv.ParseInt(v, 10, 64)
+		return n
+	default:
+		return 0
+	}
+}
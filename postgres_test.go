@@ -0,0 +1,24 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_rebind(t *testing.T) {
+	assert.Equal(t, "SELECT slug FROM redirect WHERE slug = $1 AND url = $2", rebind("SELECT slug FROM redirect WHERE slug = ? AND url = ?"))
+	assert.Equal(t, "SELECT '?', $1", rebind("SELECT '?', ?"))
+	assert.Equal(t, "SELECT 1", rebind("SELECT 1"))
+}
+
+func Test_postgresRow(t *testing.T) {
+	row := postgresRow{"text", int64(42), int32(7), true, nil}
+	assert.Equal(t, "text", row.ColumnText(0))
+	assert.Equal(t, "42", row.ColumnText(1))
+	assert.Equal(t, int64(42), row.ColumnInt64(1))
+	assert.Equal(t, 7, row.ColumnInt(2))
+	assert.True(t, row.ColumnBool(3))
+	assert.Equal(t, "", row.ColumnText(4))
+	assert.False(t, row.ColumnBool(4))
+}
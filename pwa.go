@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"html"
+	"html/template"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+//go:embed static/manifest.webmanifest
+var manifest []byte
+
+//go:embed static/sw.js
+var serviceWorker []byte
+
+//go:embed static/icon.svg
+var iconSVG []byte
+
+//go:embed static/icon-192.png
+var icon192 []byte
+
+//go:embed static/icon-512.png
+var icon512 []byte
+
+// staticHandler serves an embedded asset
+func staticHandler(contentType string, content []byte) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Cache-Control", "public, max-age=86400")
+		_, _ = w.Write(content)
+	}
+}
+
+// sharedURLPattern finds a URL in shared texts, many apps share links as text
+var sharedURLPattern = regexp.MustCompile(`https?://[^\s<>"]+`)
+
+// capturedResponse records the response of a handler to show it on a page
+type capturedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (c *capturedResponse) Header() http.Header {
+	return c.header
+}
+
+func (c *capturedResponse) Write(b []byte) (int, error) {
+	return c.body.Write(b)
+}
+
+func (c *capturedResponse) WriteHeader(status int) {
+	c.status = status
+}
+
+// shareHandler is the Web Share Target of the PWA. A shared URL (or the first
+// URL in a shared text) is shortened, any other text is saved as text link.
+func (a *app) shareHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !a.csrfProtected(r) {
+		// Another site could have sent the request, ask before creating a link
+		a.renderShare(w, r, http.StatusOK, map[string]any{"Confirm": [][]string{
+			{"url", r.PostForm.Get("url")}, {"text", r.PostForm.Get("text")}, {"title", r.PostForm.Get("title")},
+		}})
+		return
+	}
+	text := strings.TrimSpace(r.PostForm.Get("text"))
+	sharedURL := strings.TrimSpace(r.PostForm.Get("url"))
+	if sharedURL == "" {
+		sharedURL = sharedURLPattern.FindString(text)
+	}
+	form, handler, formPath := url.Values{}, a.shortenHandler, "/s"
+	if sharedURL != "" {
+		form.Set("url", sharedURL)
+	} else {
+		if text == "" {
+			text = strings.TrimSpace(r.PostForm.Get("title"))
+		}
+		form.Set("text", text)
+		handler, formPath = a.shortenTextHandler, "/t"
+	}
+
+	shortenRequest := r.Clone(r.Context())
+	shortenRequest.Body = http.NoBody
+	shortenRequest.Form, shortenRequest.PostForm = form, form
+	res := &capturedResponse{header: http.Header{}, status: http.StatusOK}
+	handler(res, shortenRequest)
+
+	data := map[string]any{"Form": formPath + "?" + form.Encode()}
+	if res.status < 300 {
+		data["Short"] = html.UnescapeString(strings.TrimSpace(res.body.String()))
+	} else {
+		data["Error"] = strings.TrimSpace(res.body.String())
+	}
+	a.renderShare(w, r, res.status, data)
+}
+
+func (a *app) renderShare(w http.ResponseWriter, r *http.Request, status int, data map[string]any) {
+	w.WriteHeader(status)
+	if err := shareTemplate.Execute(w, &templateData{Style: template.CSS(styleCSS), CSRF: a.csrfToken(r), Data: data}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPWA(t *testing.T) {
+	t.Run("Assets are public", func(t *testing.T) {
+		app := testApp(t)
+		defer closeTestApp(t, app)
+		app.config().Password = "abc"
+		router := app.initRouter()
+
+		for path, contentType := range map[string]string{
+			"/manifest.webmanifest": "application/manifest+json",
+			"/sw.js":                "text/javascript",
+			"/icon.svg":             "image/svg+xml",
+			"/icon-192.png":         "image/png",
+			"/icon-512.png":         "image/png",
+		} {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com"+path, nil))
+			assert.Equal(t, http.StatusOK, w.Code, path)
+			assert.Equal(t, contentType, w.Header().Get("Content-Type"), path)
+		}
+
+		var m struct {
+			StartURL    string `json:"start_url"`
+			ShareTarget struct {
+				Action string `json:"action"`
+				Method string `json:"method"`
+			} `json:"share_target"`
+			Icons []struct {
+				Src string `json:"src"`
+			} `json:"icons"`
+		}
+		require.NoError(t, json.Unmarshal(manifest, &m))
+		assert.Equal(t, "/s", m.StartURL)
+		assert.Equal(t, "/share", m.ShareTarget.Action)
+		assert.Equal(t, "POST", m.ShareTarget.Method)
+		assert.Len(t, m.Icons, 3)
+	})
+	t.Run("Shared URLs and texts are shortened", func(t *testing.T) {
+		app := testApp(t)
+		defer closeTestApp(t, app)
+		app.config().Password = "abc"
+		app.config().ShortUrl = "https://short.example"
+		router := app.initRouter()
+
+		share := func(form url.Values) *httptest.ResponseRecorder {
+			req := httptest.NewRequest("POST", "http://example.com/share", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			req.SetBasicAuth("username", "abc")
+			// the share menu opens the app without another site involved
+			req.Header.Set("Sec-Fetch-Site", "none")
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			return w
+		}
+
+		// a shared URL
+		w := share(url.Values{"title": {"Example"}, "url": {"https://shared.example/page"}})
+		assert.Equal(t, http.StatusCreated, w.Code)
+		assert.Contains(t, w.Body.String(), `id=copy`)
+		var slug string
+		require.NoError(t, app.db.query(context.Background(), "SELECT slug FROM redirect WHERE url = ? AND type = ?", func(stmt resultRow) error {
+			slug = stmt.ColumnText(0)
+			return nil
+		}, "https://shared.example/page", typUrl))
+		require.NotEmpty(t, slug)
+		assert.Contains(t, w.Body.String(), `value="https://short.example/`+slug+`"`)
+
+		// the URL in a shared text, sharing again returns the existing link
+		w = share(url.Values{"text": {"Look at this https://shared.example/page"}})
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), `value="https://short.example/`+slug+`"`)
+
+		// a text without URL
+		w = share(url.Values{"text": {"Just a note"}})
+		assert.Equal(t, http.StatusCreated, w.Code)
+		var typ string
+		require.NoError(t, app.db.query(context.Background(), "SELECT type FROM redirect WHERE url = ?", func(stmt resultRow) error {
+			typ = stmt.ColumnText(0)
+			return nil
+		}, "Just a note"))
+		assert.Equal(t, typText, typ)
+
+		// nothing shared
+		w = share(url.Values{})
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Contains(t, w.Body.String(), "Sharing failed")
+		assert.Contains(t, w.Body.String(), `href="/t?text="`)
+
+		// shares from other sites need a confirmation
+		req := httptest.NewRequest("POST", "http://example.com/share", strings.NewReader("url=https%3A%2F%2Fevil.example"))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Sec-Fetch-Site", "cross-site")
+		req.SetBasicAuth("username", "abc")
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), `name=csrf value="`)
+		assert.Contains(t, w.Body.String(), `value="https://evil.example"`)
+		var count int
+		require.NoError(t, app.db.query(context.Background(), "SELECT count(*) FROM redirect WHERE url = ?", func(stmt resultRow) error {
+			count = stmt.ColumnInt(0)
+			return nil
+		}, "https://evil.example"))
+		assert.Zero(t, count)
+
+		// sharing needs the password
+		req = httptest.NewRequest("POST", "http://example.com/share", strings.NewReader("url=https%3A%2F%2Fa.example"))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	})
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type rateLimitConfig struct {
+	// Proxies (IPs or CIDR ranges) whose X-Forwarded-For header is trusted
+	TrustedProxies []string `mapstructure:"trustedProxies"`
+	// Budget for requests to short links
+	Redirects bucketConfig `mapstructure:"redirects"`
+	// Budget for requests to authenticated endpoints
+	Authenticated bucketConfig `mapstructure:"authenticated"`
+	// Budget for failed authentication attempts
+	FailedAuth bucketConfig `mapstructure:"failedAuth"`
+}
+
+type bucketConfig struct {
+	// Tokens added per second, 0 disables the limiter
+	Rate float64 `mapstructure:"rate"`
+	// Maximum number of tokens
+	Burst int `mapstructure:"burst"`
+}
+
+// rateLimiter is a token bucket rate limiter keyed on client IPs.
+// A nil rateLimiter allows everything.
+type rateLimiter struct {
+	name      string
+	rate      float64
+	burst     float64
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens  float64
+	last    time.Time
+	limited bool
+}
+
+func newRateLimiter(name string, cfg bucketConfig) *rateLimiter {
+	if cfg.Rate <= 0 {
+		return nil
+	}
+	return &rateLimiter{
+		name:      name,
+		rate:      cfg.Rate,
+		burst:     math.Max(float64(cfg.Burst), 1),
+		buckets:   map[string]*bucket{},
+		lastSweep: time.Now(),
+	}
+}
+
+// refill returns the bucket for the key with tokens added for the elapsed time, l.mu must be held
+func (l *rateLimiter) refill(key string, now time.Time) *bucket {
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	return b
+}
+
+// retryAfter returns how long it takes until the bucket has a token again, l.mu must be held
+func (l *rateLimiter) retryAfter(b *bucket) time.Duration {
+	return time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// allow takes a token for the key and reports whether that was possible.
+// If not, it returns how long the client should wait.
+func (l *rateLimiter) allow(key string) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.sweep(now)
+	b := l.refill(key, now)
+	if b.tokens >= 1 {
+		b.tokens--
+		b.limited = false
+		return true, 0
+	}
+	l.markLimited(key, b)
+	return false, l.retryAfter(b)
+}
+
+// blocked reports whether the key has no tokens left without taking one.
+func (l *rateLimiter) blocked(key string) (bool, time.Duration) {
+	if l == nil {
+		return false, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b := l.refill(key, time.Now())
+	if b.tokens >= 1 {
+		b.limited = false
+		return false, 0
+	}
+	l.markLimited(key, b)
+	return true, l.retryAfter(b)
+}
+
+// markLimited logs when a client starts getting limited, l.mu must be held
+func (l *rateLimiter) markLimited(key string, b *bucket) {
+	if !b.limited {
+		b.limited = true
+		log.Printf("Rate limit %s exceeded by %s", l.name, key)
+	}
+}
+
+// sweep removes buckets that are full again and logs the limiter state, l.mu must be held
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	limited := 0
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		} else if b.limited {
+			limited++
+		}
+	}
+	if limited > 0 {
+		log.Printf("Rate limiter %s: %d clients tracked, %d limited", l.name, len(l.buckets), limited)
+	}
+}
+
+// initRateLimiters creates the rate limiters from the config
+func (a *app) initRateLimiters() {
+	cfg := a.config().RateLimit
+	a.trustedProxies = nil
+	for _, p := range cfg.TrustedProxies {
+		prefix, err := netip.ParsePrefix(p)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(p)
+			if addrErr != nil {
+				log.Println("Ignoring invalid trusted proxy:", p)
+				continue
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		a.trustedProxies = append(a.trustedProxies, prefix.Masked())
+	}
+	a.redirectLimiter = newRateLimiter("redirects", cfg.Redirects)
+	a.authLimiter = newRateLimiter("authenticated", cfg.Authenticated)
+	a.failedAuthLimiter = newRateLimiter("failedAuth", cfg.FailedAuth)
+}
+
+func (a *app) trustedProxy(addr netip.Addr) bool {
+	for _, p := range a.trustedProxies {
+		if p.Contains(addr.Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the IP of the client, using X-Forwarded-For if the request comes from a trusted proxy
+func (a *app) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err == nil && !a.trustedProxy(addr) {
+		return host
+	}
+	// Requests without an IP come from a Unix socket, so from a local proxy that is trusted as well
+	client := host
+	if err == nil {
+		client = addr.Unmap().String()
+	}
+	// Walk the chain from the closest proxy to the first untrusted address
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(forwarded[i]))
+		if err != nil {
+			break
+		}
+		client = hop.Unmap().String()
+		if !a.trustedProxy(hop) {
+			break
+		}
+	}
+	return client
+}
+
+func tooManyRequests(w http.ResponseWriter, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	http.Error(w, "Too many requests", http.StatusTooManyRequests)
+}
+
+func (a *app) rateLimitMiddleware(limiter *rateLimiter) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if ok, retryAfter := limiter.allow(a.clientIP(r)); !ok {
+				tooManyRequests(w, retryAfter)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
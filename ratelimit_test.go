@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiting(t *testing.T) {
+	t.Run("Redirects and authentication are limited per client", func(t *testing.T) {
+		app := testApp(t)
+		defer closeTestApp(t, app)
+		app.config().Password = "abc"
+		app.config().RateLimit = rateLimitConfig{
+			TrustedProxies: []string{"10.0.0.1", "192.168.0.0/16"},
+			Redirects:      bucketConfig{Rate: 0.001, Burst: 2},
+			Authenticated:  bucketConfig{Rate: 0.001, Burst: 5},
+			FailedAuth:     bucketConfig{Rate: 0.001, Burst: 2},
+		}
+
+		router := app.initRouter()
+		request := func(path, remoteAddr, forwardedFor string, basicAuth string) *http.Response {
+			req := httptest.NewRequest("GET", "http://example.com"+path, nil)
+			req.RemoteAddr = remoteAddr
+			if forwardedFor != "" {
+				req.Header.Set("X-Forwarded-For", forwardedFor)
+			}
+			if basicAuth != "" {
+				req.SetBasicAuth("username", basicAuth)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			return w.Result()
+		}
+
+		assert.Equal(t, http.StatusTemporaryRedirect, request("/source", "1.2.3.4:1000", "", "").StatusCode)
+		assert.Equal(t, http.StatusTemporaryRedirect, request("/source", "1.2.3.4:1000", "", "").StatusCode)
+		resp := request("/source", "1.2.3.4:1000", "", "")
+		assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+		assert.NotEmpty(t, resp.Header.Get("Retry-After"))
+
+		// other clients have their own budget
+		assert.Equal(t, http.StatusTemporaryRedirect, request("/source", "5.6.7.8:1000", "", "").StatusCode)
+
+		// the forwarded address is only used for trusted proxies
+		assert.Equal(t, http.StatusTooManyRequests, request("/source", "10.0.0.1:1000", "1.2.3.4", "").StatusCode)
+		assert.Equal(t, http.StatusTooManyRequests, request("/source", "10.0.0.1:1000", "1.2.3.4, 192.168.1.1", "").StatusCode)
+		assert.Equal(t, http.StatusTemporaryRedirect, request("/source", "10.0.0.2:1000", "1.2.3.4", "").StatusCode)
+
+		// requests without a password, like browsers being sent to the login page, don't count as failed attempts
+		for range 3 {
+			assert.Equal(t, http.StatusUnauthorized, request("/l", "7.7.7.7:1000", "", "").StatusCode)
+		}
+		req := httptest.NewRequest("GET", "http://example.com/l", nil)
+		req.RemoteAddr = "7.7.7.7:1000"
+		req.Header.Set("Accept", "text/html")
+		req.AddCookie(&http.Cookie{Name: sessionCookie, Value: "expired"})
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusSeeOther, w.Code)
+		assert.Equal(t, http.StatusUnauthorized, request("/l", "7.7.7.7:1000", "", "wrong").StatusCode)
+
+		// failed authentication attempts lock out the client, even with the correct password
+		assert.Equal(t, http.StatusUnauthorized, request("/l", "9.9.9.9:1000", "", "wrong").StatusCode)
+		assert.Equal(t, http.StatusUnauthorized, request("/l", "9.9.9.9:1000", "", "wrong").StatusCode)
+		assert.Equal(t, http.StatusTooManyRequests, request("/l", "9.9.9.9:1000", "", "abc").StatusCode)
+		assert.Equal(t, http.StatusOK, request("/l", "8.8.8.8:1000", "", "abc").StatusCode)
+
+		// authenticated requests have a separate budget
+		for range 4 {
+			assert.Equal(t, http.StatusOK, request("/l", "8.8.8.8:1000", "", "abc").StatusCode)
+		}
+		assert.Equal(t, http.StatusTooManyRequests, request("/l", "8.8.8.8:1000", "", "abc").StatusCode)
+	})
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"log"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/viper"
+)
+
+// Settings that are applied to the running app when the config file changes,
+// all other settings require a restart.
+var reloadableSettings = []string{"password", "passwordFile", "shortUrl", "defaultUrl", "policy", "session", "disablePasswordParam"}
+
+// changedSettings returns the names of the top level settings that differ
+func changedSettings(old, next *config) (changed []string) {
+	o, n := reflect.ValueOf(old).Elem(), reflect.ValueOf(next).Elem()
+	for i := range o.NumField() {
+		if !reflect.DeepEqual(o.Field(i).Interface(), n.Field(i).Interface()) {
+			changed = append(changed, o.Type().Field(i).Tag.Get("mapstructure"))
+		}
+	}
+	return
+}
+
+// reloadConfig validates a new config and swaps the reloadable settings into
+// the running app. Other changed settings are only logged.
+func (a *app) reloadConfig(next *config) error {
+	if err := validateConfig(next); err != nil {
+		return err
+	}
+	old := a.config()
+	changed := changedSettings(old, next)
+	if len(changed) == 0 {
+		return nil
+	}
+	updated := *old
+	updated.Password = next.Password
+	updated.PasswordFile = next.PasswordFile
+	updated.ShortUrl = next.ShortUrl
+	updated.DefaultUrl = next.DefaultUrl
+	updated.Policy = next.Policy
+	updated.Session = next.Session
+	updated.DisablePasswordParam = next.DisablePasswordParam
+	blocklistChanged := old.Policy.BlocklistFile != next.Policy.BlocklistFile
+	if blocklistChanged {
+		// Load the new blocklist before switching, so a missing file keeps the old config
+		if err := a.loadBlocklist(next.Policy.BlocklistFile); err != nil {
+			return err
+		}
+	}
+	a.conf.Store(&updated)
+	if old.Password != next.Password {
+		// Logins with the old password must not stay valid
+		if err := a.deleteSessions(context.Background(), ""); err != nil {
+			log.Println("Failed to revoke sessions:", err.Error())
+		}
+	}
+	if blocklistChanged {
+		if err := a.watchBlocklist(next.Policy.BlocklistFile); err != nil {
+			log.Println("Failed to watch blocklist:", err.Error())
+		}
+	}
+
+	var applied, restart []string
+	for _, setting := range changed {
+		if slices.Contains(reloadableSettings, setting) {
+			applied = append(applied, setting)
+		} else {
+			restart = append(restart, setting)
+		}
+	}
+	if len(applied) > 0 {
+		log.Println("Reloaded config, changed settings:", strings.Join(applied, ", "))
+	}
+	if len(restart) > 0 {
+		log.Println("Changed settings that require a restart:", strings.Join(restart, ", "))
+	}
+	return nil
+}
+
+// watchConfig reloads the config whenever the config file changes.
+func (a *app) watchConfig() {
+	if viper.ConfigFileUsed() == "" {
+		return
+	}
+	viper.OnConfigChange(func(fsnotify.Event) {
+		next, err := unmarshalConfig(viper.GetViper())
+		if err != nil {
+			log.Println("Failed to reload config:", err.Error())
+			return
+		}
+		if err := a.reloadConfig(next); err != nil {
+			log.Println("Failed to reload config, keeping the current config:", err.Error())
+		}
+	})
+	viper.WatchConfig()
+}
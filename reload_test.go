@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_changedSettings(t *testing.T) {
+	old := &config{Port: 8080, Password: "abc", Policy: policyConfig{DenyDomains: []string{"a.example"}}}
+	next := &config{Port: 9090, Password: "abc", Policy: policyConfig{DenyDomains: []string{"b.example"}}}
+	assert.Equal(t, []string{"port", "policy"}, changedSettings(old, next))
+	assert.Empty(t, changedSettings(old, old))
+}
+
+func TestReloadConfig(t *testing.T) {
+	t.Run("Reloadable settings are swapped into the running app", func(t *testing.T) {
+		app := testApp(t)
+		defer closeTestApp(t, app)
+		app.config().Password = "abc"
+		app.config().ShortUrl = "https://short.example"
+		app.config().DefaultUrl = "https://default.example"
+		require.NoError(t, app.initPolicy())
+
+		router := app.initRouter()
+		request := func(path string) *http.Response {
+			req := httptest.NewRequest("GET", "http://example.com"+path, nil)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			return w.Result()
+		}
+
+		blocklistFile := filepath.Join(t.TempDir(), "blocklist.txt")
+		require.NoError(t, os.WriteFile(blocklistFile, []byte("blocked.example\n"), 0o644))
+
+		session, _, err := app.createSession(context.Background(), passwordUser)
+		require.NoError(t, err)
+
+		next := *app.config()
+		next.Password = "def"
+		next.DefaultUrl = "https://other.example"
+		next.Policy.BlocklistFile = blocklistFile
+		next.Port = 9999
+		require.NoError(t, app.reloadConfig(&next))
+
+		assert.Equal(t, http.StatusUnauthorized, request("/l?password=abc").StatusCode)
+		assert.Equal(t, http.StatusOK, request("/l?password=def").StatusCode)
+		// sessions of the old password are revoked
+		req := httptest.NewRequest("GET", "http://example.com/l", nil)
+		req.AddCookie(&http.Cookie{Name: sessionCookie, Value: session})
+		_, ok := app.sessionUser(req)
+		assert.False(t, ok)
+		assert.Equal(t, "https://other.example", request("/").Header.Get("Location"))
+		assert.Error(t, app.checkDestination("https://blocked.example"))
+		// settings requiring a restart are kept
+		assert.Equal(t, 0, app.config().Port)
+
+		// invalid configs are rejected and the current config is kept
+		invalid := *app.config()
+		invalid.Password = ""
+		assert.Error(t, app.reloadConfig(&invalid))
+		missing := *app.config()
+		missing.Password = "ghi"
+		missing.Policy.BlocklistFile = filepath.Join(t.TempDir(), "missing.txt")
+		assert.Error(t, app.reloadConfig(&missing))
+		assert.Equal(t, "def", app.config().Password)
+		assert.Error(t, app.checkDestination("https://blocked.example"))
+	})
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// renameSlug moves a link including hits, creation date, history and aliases
+// to a new slug. If keep is set, the old slug stays working as an alias.
+func (a *app) renameSlug(ctx context.Context, slug, newSlug string, keep bool) error {
+	a.write.Lock()
+	defer a.write.Unlock()
+	defer a.cache.invalidate(slug, newSlug)
+	return a.db.transaction(ctx, func(tx storage) error {
+		// The new slug might be an alias of the link already
+		if _, err := tx.exec(ctx, "DELETE FROM alias WHERE slug = ? AND link = ?", newSlug, slug); err != nil {
+			return err
+		}
+		if err := moveLink(ctx, tx, slug, newSlug); err != nil {
+			return err
+		}
+		if !keep {
+			return nil
+		}
+		_, err := tx.exec(ctx, "INSERT INTO alias (slug, link) VALUES (?, ?)", slug, newSlug)
+		return err
+	})
+}
+
+// keepByDefault is the default of the keep parameter, so renaming doesn't break
+// links to the old slug unless asked to
+const keepByDefault = true
+
+// keepOldSlug returns the keep parameter of a rename request
+func keepOldSlug(r *http.Request) (bool, error) {
+	v := r.FormValue("keep")
+	if v == "" {
+		return keepByDefault, nil
+	}
+	return strconv.ParseBool(v)
+}
+
+func (a *app) renameFormHandler(w http.ResponseWriter, r *http.Request) {
+	keep, err := keepOldSlug(r)
+	if err != nil {
+		keep = keepByDefault
+	}
+	if err := a.generateURLForm(w, r, "Rename short link", "rename", [][]string{{"slug", r.FormValue("slug")}, {"new", r.FormValue("new")}, {"keep", strconv.FormatBool(keep)}}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (a *app) renameHandler(w http.ResponseWriter, r *http.Request) {
+	slug, newSlug := a.requestSlug(r), a.normalizeSlug(r.FormValue("new"))
+	if slug == "" || newSlug == "" {
+		http.Error(w, "Specify the slug to rename and the new slug", http.StatusBadRequest)
+		return
+	}
+	keep, err := keepOldSlug(r)
+	if err != nil {
+		http.Error(w, "keep parameter has to be true or false", http.StatusBadRequest)
+		return
+	}
+
+	if e, err := a.slugActive(slug); !e || err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if newSlug == slug {
+		http.Error(w, "The new slug is the current slug", http.StatusBadRequest)
+		return
+	}
+	if a.slugReserved(newSlug) {
+		http.Error(w, errReservedSlug, http.StatusBadRequest)
+		return
+	}
+	if err := a.validateSlug(newSlug); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Aliases of the same link can become the new slug
+	owner, err := a.linkSlug(r.Context(), newSlug)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if owner != slug {
+		if e, err := a.slugExists(newSlug); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		} else if e {
+			http.Error(w, "slug already in use", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := a.renameSlug(r.Context(), slug, newSlug, keep); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	_, _ = io.WriteString(w, "Slug renamed")
+}
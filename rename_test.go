@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRename(t *testing.T) {
+	t.Run("Renaming moves the link and optionally keeps the old slug", func(t *testing.T) {
+		app := testApp(t)
+		defer closeTestApp(t, app)
+		app.config().Password = "abc"
+
+		router := app.initRouter()
+		rename := func(values url.Values) int {
+			values.Set("password", "abc")
+			req := httptest.NewRequest("POST", "http://example.com/rename", strings.NewReader(values.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			return w.Result().StatusCode
+		}
+		location := func(slug string) string {
+			req := httptest.NewRequest("GET", "http://example.com/"+slug, nil)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			return w.Result().Header.Get("Location")
+		}
+
+		require.NoError(t, app.insertRedirect("old", "https://one.example", typUrl))
+		require.NoError(t, app.updateSlug(context.Background(), "https://two.example", typUrl, "old"))
+
+		// taken, reserved and unknown slugs
+		assert.Equal(t, http.StatusBadRequest, rename(url.Values{"slug": {"old"}, "new": {"source"}}))
+		assert.Equal(t, http.StatusBadRequest, rename(url.Values{"slug": {"old"}, "new": {"rename"}}))
+		assert.Equal(t, http.StatusBadRequest, rename(url.Values{"slug": {"old"}, "new": {"other"}, "keep": {"maybe"}}))
+		assert.Equal(t, http.StatusNotFound, rename(url.Values{"slug": {"unknown"}, "new": {"other"}}))
+
+		// rename and keep the old slug, which is the default
+		assert.Equal(t, http.StatusAccepted, rename(url.Values{"slug": {"old"}, "new": {"new"}}))
+		assert.Equal(t, "https://two.example", location("new"))
+		assert.Equal(t, "https://two.example", location("old"))
+		revisions, err := app.getRevisions(context.Background(), "new")
+		require.NoError(t, err)
+		assert.Len(t, revisions, 1)
+		aliases, err := app.getAliases(context.Background(), "new")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"old"}, aliases)
+
+		// rename back to the alias without keeping the previous slug
+		assert.Equal(t, http.StatusAccepted, rename(url.Values{"slug": {"new"}, "new": {"old"}, "keep": {"false"}}))
+		assert.Equal(t, "https://two.example", location("old"))
+		assert.Empty(t, location("new"))
+		aliases, err = app.getAliases(context.Background(), "old")
+		require.NoError(t, err)
+		assert.Empty(t, aliases)
+		exists, err := app.slugExists("new")
+		require.NoError(t, err)
+		assert.False(t, exists)
+	})
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const errReservedSlug = "slug is reserved for a route or by the configuration"
+
+// initReservedSlugs collects the first path segments of all routes, which
+// would shadow links with the same slug, and adds the configured reserved slugs.
+func (a *app) initReservedSlugs(routes chi.Routes) {
+	reserved := map[string]bool{}
+	_ = chi.Walk(routes, func(_, route string, _ http.Handler, _ ...func(http.Handler) http.Handler) error {
+		segment, _, _ := strings.Cut(strings.TrimPrefix(route, "/"), "/")
+		if segment != "" && !strings.ContainsAny(segment, "{*") {
+			reserved[segment] = true
+		}
+		return nil
+	})
+	for _, slug := range a.config().ReservedSlugs {
+		reserved[a.normalizeSlug(slug)] = true
+	}
+	a.reservedSlugs = reserved
+}
+
+// slugReserved reports whether a slug can't be used for links
+func (a *app) slugReserved(slug string) bool {
+	return a.reservedSlugs[slug]
+}
+
+// checkShadowedSlugs logs existing links that are shadowed by reserved slugs and returns them
+func (a *app) checkShadowedSlugs(ctx context.Context) (shadowed []string, err error) {
+	err = a.db.query(ctx, "SELECT slug FROM redirect WHERE deleted IS NULL UNION SELECT alias.slug FROM alias JOIN redirect ON redirect.slug = alias.link WHERE redirect.deleted IS NULL ORDER BY slug", func(stmt resultRow) error {
+		if slug := stmt.ColumnText(0); a.slugReserved(slug) {
+			shadowed = append(shadowed, slug)
+		}
+		return nil
+	})
+	for _, slug := range shadowed {
+		log.Printf("Link %q is not reachable because the slug is reserved, rename or delete it", slug)
+	}
+	return
+}
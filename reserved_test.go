@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReservedSlugs(t *testing.T) {
+	t.Run("Routes and configured slugs are reserved", func(t *testing.T) {
+		app := testApp(t)
+		defer closeTestApp(t, app)
+		app.config().Password = "abc"
+		app.config().ReservedSlugs = []string{"admin"}
+
+		// links created before the routes or config existed
+		require.NoError(t, app.insertRedirect("l", "https://l.example", typUrl))
+		require.NoError(t, app.insertRedirect("admin", "https://admin.example", typUrl))
+
+		router := app.initRouter()
+
+		for _, slug := range []string{"s", "t", "u", "d", "l", "h", "r", "trash", "broken", "admin"} {
+			assert.True(t, app.slugReserved(slug), slug)
+		}
+		assert.False(t, app.slugReserved("source"))
+		assert.False(t, app.slugReserved(""))
+
+		shadowed, err := app.checkShadowedSlugs(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, []string{"admin", "l"}, shadowed)
+
+		post := func(path string, form url.Values) (int, string) {
+			form.Set("password", "abc")
+			req := httptest.NewRequest("POST", "http://example.com"+path, strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			return w.Result().StatusCode, w.Body.String()
+		}
+
+		code, body := post("/s", url.Values{"url": {"https://example.com"}, "slug": {"trash"}})
+		assert.Equal(t, http.StatusBadRequest, code)
+		assert.Contains(t, body, "reserved")
+		code, _ = post("/t", url.Values{"text": {"Hello"}, "slug": {"admin"}})
+		assert.Equal(t, http.StatusBadRequest, code)
+		code, _ = post("/u", url.Values{"slug": {"l"}, "new": {"https://example.com"}})
+		assert.Equal(t, http.StatusBadRequest, code)
+		code, _ = post("/s", url.Values{"url": {"https://example.com"}, "slug": {"free"}})
+		assert.Equal(t, http.StatusCreated, code)
+
+		// generated slugs skip reserved ones
+		app.config().Slugs = slugConfig{Length: 1, Alphabet: "lu", MaxAttempts: 1}
+		_, err = app.newSlug(context.Background(), "")
+		assert.Error(t, err)
+	})
+}
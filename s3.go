@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+type s3Config struct {
+	// URL of the S3-compatible endpoint like https://s3.eu-central-1.amazonaws.com, uploads are disabled if empty
+	Endpoint string `mapstructure:"endpoint"`
+	Bucket   string `mapstructure:"bucket"`
+	// Prefix of the object names like goshort/
+	Prefix    string `mapstructure:"prefix"`
+	Region    string `mapstructure:"region"`
+	AccessKey string `mapstructure:"accessKey"`
+	SecretKey string `mapstructure:"secretKey" secret:"true"`
+	// Number of backups to keep in the bucket, 0 keeps all
+	Keep int `mapstructure:"keep"`
+}
+
+func newS3Client(cfg s3Config) (*minio.Client, error) {
+	u, err := url.Parse(cfg.Endpoint)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("invalid S3 endpoint %q", cfg.Endpoint)
+	}
+	return minio.New(u.Host, &minio.Options{
+		Creds:  credentials.NewStaticV4(cfg.AccessKey, cfg.SecretKey, ""),
+		Secure: u.Scheme == "https",
+		Region: cfg.Region,
+	})
+}
+
+// uploadBackup uploads a backup file to the bucket and deletes old backups in the bucket
+func uploadBackup(ctx context.Context, cfg s3Config, path string) error {
+	client, err := newS3Client(cfg)
+	if err != nil {
+		return err
+	}
+	_, err = client.FPutObject(ctx, cfg.Bucket, cfg.Prefix+filepath.Base(path), path, minio.PutObjectOptions{
+		ContentType: "application/vnd.sqlite3",
+	})
+	if err != nil {
+		return err
+	}
+	names, err := listS3Backups(ctx, client, cfg)
+	if err != nil {
+		return err
+	}
+	for _, name := range expiredBackups(names, cfg.Keep) {
+		if err := client.RemoveObject(ctx, cfg.Bucket, cfg.Prefix+name, minio.RemoveObjectOptions{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listS3Backups returns the names (without prefix) of the backups in the bucket, oldest first
+func listS3Backups(ctx context.Context, client *minio.Client, cfg s3Config) ([]string, error) {
+	var names []string
+	for object := range client.ListObjects(ctx, cfg.Bucket, minio.ListObjectsOptions{Prefix: cfg.Prefix}) {
+		if object.Err != nil {
+			return nil, object.Err
+		}
+		name := strings.TrimPrefix(object.Key, cfg.Prefix)
+		if _, ok := backupTime(name); ok {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	return names, nil
+}
+
+// downloadBackup downloads a backup from the bucket to path, the newest one if name is empty
+func downloadBackup(ctx context.Context, cfg s3Config, name, path string) (string, error) {
+	client, err := newS3Client(cfg)
+	if err != nil {
+		return "", err
+	}
+	if name == "" {
+		names, err := listS3Backups(ctx, client, cfg)
+		if err != nil {
+			return "", err
+		}
+		if len(names) == 0 {
+			return "", errors.New("no backups in the bucket")
+		}
+		name = names[len(names)-1]
+	}
+	return name, client.FGetObject(ctx, cfg.Bucket, cfg.Prefix+name, path, minio.GetObjectOptions{})
+}
+
+// runRestoreS3Command replaces the configured database with a backup from the bucket
+func runRestoreS3Command(cfg *config, name string) int {
+	if cfg.Backup.S3.Endpoint == "" {
+		fmt.Fprintln(os.Stderr, "No S3 endpoint (backup.s3.endpoint) is configured")
+		return 1
+	}
+	if cfg.DatabaseUrl != "" {
+		fmt.Fprintln(os.Stderr, errBackupUnsupported.Error())
+		return 1
+	}
+	dir, err := os.MkdirTemp("", "goshort")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "backup.db")
+	name, err = downloadBackup(context.Background(), cfg.Backup.S3, name, path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Download failed:", err.Error())
+		return 1
+	}
+	if err := restoreBackup(path, cfg.DBPath); err != nil {
+		fmt.Fprintln(os.Stderr, "Restore failed:", err.Error())
+		return 1
+	}
+	fmt.Println("Restored database from", name)
+	return 0
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_expiredBackups(t *testing.T) {
+	names := []string{"goshort-20200101-000000.db", "goshort-20210101-000000.db", "goshort-20220101-000000.db"}
+	assert.Equal(t, names[:1], expiredBackups(names, 2))
+	assert.Empty(t, expiredBackups(names, 3))
+	assert.Empty(t, expiredBackups(names, 0))
+}
+
+func Test_newS3Client(t *testing.T) {
+	_, err := newS3Client(s3Config{Endpoint: "localhost:9000"})
+	assert.ErrorContains(t, err, "invalid S3 endpoint")
+	client, err := newS3Client(s3Config{Endpoint: "http://localhost:9000"})
+	require.NoError(t, err)
+	assert.Equal(t, "http", client.EndpointURL().Scheme)
+}
+
+// TestS3Backup needs a running S3-compatible server, e.g. MinIO started with
+// "minio server /tmp/minio", and the environment variable GOSHORT_TEST_S3_ENDPOINT
+// (like http://localhost:9000). GOSHORT_TEST_S3_ACCESS_KEY and GOSHORT_TEST_S3_SECRET_KEY
+// default to the MinIO defaults.
+func TestS3Backup(t *testing.T) {
+	endpoint := os.Getenv("GOSHORT_TEST_S3_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("no S3 test server configured")
+	}
+	accessKey, secretKey := os.Getenv("GOSHORT_TEST_S3_ACCESS_KEY"), os.Getenv("GOSHORT_TEST_S3_SECRET_KEY")
+	if accessKey == "" {
+		accessKey, secretKey = "minioadmin", "minioadmin"
+	}
+
+	app := testApp(t)
+	defer closeTestApp(t, app)
+	if _, ok := app.db.(*sqliteStorage); !ok {
+		t.Skip("backups are only supported for SQLite")
+	}
+	s3 := s3Config{
+		Endpoint:  endpoint,
+		Bucket:    "goshort-test-" + strconv.FormatInt(time.Now().UnixNano(), 36),
+		Prefix:    "backups/",
+		AccessKey: accessKey,
+		SecretKey: secretKey,
+		Keep:      2,
+	}
+	app.config().Backup = backupConfig{Dir: t.TempDir(), S3: s3}
+
+	ctx := context.Background()
+	client, err := newS3Client(s3)
+	require.NoError(t, err)
+	require.NoError(t, client.MakeBucket(ctx, s3.Bucket, minio.MakeBucketOptions{}))
+	defer func() {
+		for object := range client.ListObjects(ctx, s3.Bucket, minio.ListObjectsOptions{Recursive: true}) {
+			_ = client.RemoveObject(ctx, s3.Bucket, object.Key, minio.RemoveObjectOptions{})
+		}
+		_ = client.RemoveBucket(ctx, s3.Bucket)
+	}()
+	for _, key := range []string{"backups/goshort-20200101-000000.db", "backups/goshort-20210101-000000.db", "other/goshort-20200101-000000.db"} {
+		_, err := client.PutObject(ctx, s3.Bucket, key, bytes.NewReader(nil), 0, minio.PutObjectOptions{})
+		require.NoError(t, err)
+	}
+
+	// the backup is uploaded and old backups with the prefix are deleted
+	require.NoError(t, app.insertRedirect("backedup", "https://a.example", typUrl))
+	path, err := app.scheduledBackup(ctx)
+	require.NoError(t, err)
+	names, err := listS3Backups(ctx, client, s3)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"goshort-20210101-000000.db", filepath.Base(path)}, names)
+	_, err = client.StatObject(ctx, s3.Bucket, "other/goshort-20200101-000000.db", minio.StatObjectOptions{})
+	assert.NoError(t, err)
+
+	// the newest backup is restored
+	cfg := &config{DBPath: filepath.Join(t.TempDir(), "restored.db"), Backup: backupConfig{S3: s3}}
+	require.Equal(t, 0, runRestoreS3Command(cfg, ""))
+	restored := newApp(cfg)
+	require.NoError(t, restored.openDatabase())
+	defer closeTestApp(t, restored)
+	exists, err := restored.slugExists("backedup")
+	require.NoError(t, err)
+	assert.True(t, exists)
+
+	// the invalid older backup is rejected
+	assert.Equal(t, 1, runRestoreS3Command(cfg, "goshort-20210101-000000.db"))
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type sessionConfig struct {
+	// How long a login is valid
+	Lifetime time.Duration `mapstructure:"lifetime"`
+}
+
+const (
+	sessionCookie          = "goshort_session"
+	defaultSessionLifetime = 30 * 24 * time.Hour
+)
+
+// hashSessionID returns the ID under which a session is stored, so that the
+// database doesn't contain usable session cookies
+func hashSessionID(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:])
+}
+
+// Roles of users, admins can additionally use the maintenance routes
+const (
+	roleAdmin = "admin"
+	roleUser  = "user"
+)
+
+// user is the identity a request is authenticated with
+type user struct {
+	// Email or subject of single sign-on users, empty for the password
+	name string
+	role string
+}
+
+// passwordUser is the user of logins with the password
+var passwordUser = user{role: roleAdmin}
+
+type userContextKey struct{}
+
+// requestUser returns the user that loginMiddleware authenticated
+func requestUser(r *http.Request) user {
+	u, _ := r.Context().Value(userContextKey{}).(user)
+	return u
+}
+
+// createSession stores a new session for the user and deletes expired ones
+func (a *app) createSession(ctx context.Context, u user) (id string, expires time.Time, err error) {
+	id = rand.Text()
+	lifetime := a.config().Session.Lifetime
+	if lifetime == 0 {
+		lifetime = defaultSessionLifetime
+	}
+	expires = time.Now().Add(lifetime)
+	a.write.Lock()
+	defer a.write.Unlock()
+	err = a.db.transaction(ctx, func(tx storage) error {
+		if _, err := tx.exec(ctx, "DELETE FROM session WHERE expires <= unixepoch()"); err != nil {
+			return err
+		}
+		_, err := tx.exec(ctx, "INSERT INTO session (id, created, expires, username, role) VALUES (?, unixepoch(), ?, ?, ?)", hashSessionID(id), expires.Unix(), u.name, u.role)
+		return err
+	})
+	return
+}
+
+// sessionUser returns the user of the session cookie of the request, if the session is valid
+func (a *app) sessionUser(r *http.Request) (u user, ok bool) {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil || cookie.Value == "" {
+		return user{}, false
+	}
+	err = a.db.query(r.Context(), "SELECT username, role FROM session WHERE id = ? AND expires > unixepoch()", func(stmt resultRow) error {
+		u, ok = user{name: stmt.ColumnText(0), role: stmt.ColumnText(1)}, true
+		return nil
+	}, hashSessionID(cookie.Value))
+	return u, err == nil && ok
+}
+
+// requireAdmin restricts routes to admins
+func requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requestUser(r).role != roleAdmin {
+			http.Error(w, "Only admins are allowed to do this", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// deleteSessions revokes the session with the ID, or all sessions if id is empty
+func (a *app) deleteSessions(ctx context.Context, id string) error {
+	a.write.Lock()
+	defer a.write.Unlock()
+	if id == "" {
+		_, err := a.db.exec(ctx, "DELETE FROM session")
+		return err
+	}
+	_, err := a.db.exec(ctx, "DELETE FROM session WHERE id = ?", hashSessionID(id))
+	return err
+}
+
+func (a *app) setSessionCookie(w http.ResponseWriter, r *http.Request, id string, expires time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    id,
+		Path:     "/",
+		Expires:  expires,
+		MaxAge:   int(time.Until(expires).Seconds()),
+		Secure:   r.TLS != nil || strings.HasPrefix(a.config().ShortUrl, "https://"),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// loginRedirect sends browsers to the login page and returns to the requested page afterwards
+func loginRedirect(w http.ResponseWriter, r *http.Request) {
+	http.Redirect(w, r, "/login?"+url.Values{"next": {r.URL.RequestURI()}}.Encode(), http.StatusSeeOther)
+}
+
+// localRedirectTarget returns the path to redirect to after the login, only paths
+// of GoShort are allowed
+func localRedirectTarget(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/l"
+	}
+	return next
+}
+
+func (a *app) loginFormHandler(w http.ResponseWriter, r *http.Request) {
+	a.renderLogin(w, http.StatusOK, r.FormValue("next"), "")
+}
+
+func (a *app) renderLogin(w http.ResponseWriter, status int, next, message string) {
+	cfg := a.config()
+	sso := ""
+	if cfg.OIDC.Issuer != "" {
+		sso = cfg.OIDC.Name
+	}
+	w.WriteHeader(status)
+	if err := loginTemplate.Execute(w, &templateData{Style: template.CSS(styleCSS), Data: map[string]any{
+		"Next":      next,
+		"Message":   message,
+		"Password":  cfg.Password != "",
+		"SSO":       sso,
+		"IndieAuth": cfg.IndieAuth.Me != "",
+	}}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (a *app) loginHandler(w http.ResponseWriter, r *http.Request) {
+	ip := a.clientIP(r)
+	if blocked, retryAfter := a.failedAuthLimiter.blocked(ip); blocked {
+		tooManyRequests(w, retryAfter)
+		return
+	}
+	next := localRedirectTarget(r.PostFormValue("next"))
+	if !a.passwordMatches(r.PostFormValue("password")) {
+		a.failedAuthLimiter.allow(ip)
+		a.renderLogin(w, http.StatusUnauthorized, next, "Wrong password")
+		return
+	}
+	id, expires, err := a.createSession(r.Context(), passwordUser)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	a.setSessionCookie(w, r, id, expires)
+	http.Redirect(w, r, next, http.StatusSeeOther)
+}
+
+// logoutHandler revokes the session of the request, or all sessions with all=true
+func (a *app) logoutHandler(w http.ResponseWriter, r *http.Request) {
+	id := ""
+	if cookie, err := r.Cookie(sessionCookie); err == nil {
+		id = cookie.Value
+	}
+	if r.FormValue("all") == "true" {
+		if requestUser(r).role != roleAdmin {
+			http.Error(w, "Only admins are allowed to end all sessions", http.StatusForbidden)
+			return
+		}
+		id = ""
+	} else if id == "" {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	if err := a.deleteSessions(r.Context(), id); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	a.setSessionCookie(w, r, "", time.Unix(0, 0))
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSession(t *testing.T) {
+	t.Run("Log in and out", func(t *testing.T) {
+		app := testApp(t)
+		defer closeTestApp(t, app)
+		app.config().Password = "abc"
+		router := app.initRouter()
+
+		do := func(method, path string, form url.Values, cookie *http.Cookie) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(method, "http://example.com"+path, strings.NewReader(form.Encode()))
+			req.Header.Set("Accept", "text/html")
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if cookie != nil {
+				req.AddCookie(cookie)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			return w
+		}
+
+		// browsers are sent to the login page
+		w := do("GET", "/l?sort=hits", nil, nil)
+		assert.Equal(t, http.StatusSeeOther, w.Code)
+		assert.Equal(t, "/login?next=%2Fl%3Fsort%3Dhits", w.Header().Get("Location"))
+		w = do("GET", "/login?next=%2Fl%3Fsort%3Dhits", nil, nil)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), `name=next value="/l?sort=hits"`)
+
+		w = do("POST", "/login", url.Values{"password": {"wrong"}, "next": {"/l?sort=hits"}}, nil)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		assert.Contains(t, w.Body.String(), "Wrong password")
+		assert.Empty(t, w.Result().Cookies())
+
+		w = do("POST", "/login", url.Values{"password": {"abc"}, "next": {"/l?sort=hits"}}, nil)
+		assert.Equal(t, http.StatusSeeOther, w.Code)
+		assert.Equal(t, "/l?sort=hits", w.Header().Get("Location"))
+		require.Len(t, w.Result().Cookies(), 1)
+		cookie := w.Result().Cookies()[0]
+		assert.Equal(t, sessionCookie, cookie.Name)
+		assert.True(t, cookie.HttpOnly)
+		assert.Equal(t, http.SameSiteLaxMode, cookie.SameSite)
+		assert.WithinDuration(t, time.Now().Add(30*24*time.Hour), cookie.Expires, time.Minute)
+
+		// the session authenticates, posts need the CSRF token
+		w = do("GET", "/l", nil, cookie)
+		assert.Equal(t, http.StatusOK, w.Code)
+		match := regexp.MustCompile(`action=/logout method=post><input type=hidden name=csrf value="([^"]+)"`).FindStringSubmatch(w.Body.String())
+		require.Len(t, match, 2)
+		assert.Equal(t, http.StatusForbidden, do("POST", "/s", url.Values{"url": {"https://a.example"}}, cookie).Code)
+		assert.Equal(t, http.StatusCreated, do("POST", "/s", url.Values{"url": {"https://a.example"}, "csrf": {match[1]}}, cookie).Code)
+
+		// logging out revokes the session
+		w = do("POST", "/logout", url.Values{"csrf": {match[1]}}, cookie)
+		assert.Equal(t, http.StatusSeeOther, w.Code)
+		assert.Equal(t, "/login", w.Header().Get("Location"))
+		require.Len(t, w.Result().Cookies(), 1)
+		assert.Equal(t, -1, w.Result().Cookies()[0].MaxAge)
+		assert.Equal(t, http.StatusSeeOther, do("GET", "/l", nil, cookie).Code)
+	})
+	t.Run("Sessions expire and can be revoked", func(t *testing.T) {
+		app := testApp(t)
+		defer closeTestApp(t, app)
+		app.config().Password = "abc"
+		ctx := context.Background()
+
+		valid := func(id string) bool {
+			req := httptest.NewRequest("GET", "http://example.com/l", nil)
+			req.AddCookie(&http.Cookie{Name: sessionCookie, Value: id})
+			_, ok := app.sessionUser(req)
+			return ok
+		}
+
+		app.config().Session.Lifetime = -time.Minute
+		expired, _, err := app.createSession(ctx, passwordUser)
+		require.NoError(t, err)
+		assert.False(t, valid(expired))
+
+		app.config().Session.Lifetime = time.Hour
+		first, _, err := app.createSession(ctx, passwordUser)
+		require.NoError(t, err)
+		second, _, err := app.createSession(ctx, passwordUser)
+		require.NoError(t, err)
+		assert.True(t, valid(first))
+		assert.False(t, valid("unknown"))
+
+		// expired sessions are deleted and only hashes are stored
+		var ids []string
+		require.NoError(t, app.db.query(ctx, "SELECT id FROM session ORDER BY created", func(stmt resultRow) error {
+			ids = append(ids, stmt.ColumnText(0))
+			return nil
+		}))
+		assert.ElementsMatch(t, []string{hashSessionID(first), hashSessionID(second)}, ids)
+
+		require.NoError(t, app.deleteSessions(ctx, first))
+		assert.False(t, valid(first))
+		assert.True(t, valid(second))
+		require.NoError(t, app.deleteSessions(ctx, ""))
+		assert.False(t, valid(second))
+	})
+	t.Run("Only local redirects after the login", func(t *testing.T) {
+		assert.Equal(t, "/l?sort=hits", localRedirectTarget("/l?sort=hits"))
+		assert.Equal(t, "/l", localRedirectTarget("https://evil.example"))
+		assert.Equal(t, "/l", localRedirectTarget("//evil.example"))
+		assert.Equal(t, "/l", localRedirectTarget(`/\evil.example`))
+		assert.Equal(t, "/l", localRedirectTarget(""))
+	})
+	t.Run("Disable the password parameter", func(t *testing.T) {
+		app := testApp(t)
+		defer closeTestApp(t, app)
+		app.config().Password = "abc"
+		app.config().DisablePasswordParam = true
+
+		req := httptest.NewRequest("GET", "http://example.com/l?password=abc", nil)
+		assert.False(t, app.checkPassword(httptest.NewRecorder(), req))
+		req = httptest.NewRequest("GET", "http://example.com/l", nil)
+		req.Header.Set("Authorization", "Bearer abc")
+		assert.True(t, app.checkPassword(httptest.NewRecorder(), req))
+	})
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	_ "embed"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"math/rand/v2"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type slugConfig struct {
+	// One of random, pronounceable, words, sequence or hash
+	Strategy string `mapstructure:"strategy"`
+	// Minimum length of generated slugs (number of words for the words strategy)
+	Length int `mapstructure:"length"`
+	// Characters used for random, sequence and hash slugs
+	Alphabet string `mapstructure:"alphabet"`
+	// File with one word per line for the words strategy
+	WordList string `mapstructure:"wordList"`
+	// Salt for the sequence and hash strategies
+	Salt string `mapstructure:"salt" secret:"true"`
+	// Maximum number of tries to find a free slug
+	MaxAttempts int `mapstructure:"maxAttempts"`
+}
+
+const (
+	slugRandom        = "random"
+	slugPronounceable = "pronounceable"
+	slugWords         = "words"
+	slugSequence      = "sequence"
+	slugHash          = "hash"
+
+	defaultSlugAlphabet = "0123456789abcdefghijklmnopqrstuvwxyz"
+	defaultSlugLength   = 6
+	defaultWordCount    = 3
+)
+
+//go:embed static/words.txt
+var defaultWordList string
+
+// slugGenerator keeps the state of slug generation and grows the slug length
+// when too many generated slugs collide with existing ones.
+type slugGenerator struct {
+	mu          sync.Mutex
+	words       []string
+	growth      int
+	generations int
+	collided    int
+}
+
+// Number of generations after which the collision rate is evaluated
+const slugCollisionWindow = 50
+
+// record tracks the collisions of a generation and grows the slug length if
+// more than a fifth of the generations in a window needed retries.
+func (g *slugGenerator) record(collisions int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.generations++
+	if collisions > 0 {
+		g.collided++
+	}
+	if g.generations < slugCollisionWindow {
+		return
+	}
+	if g.collided*5 > g.generations {
+		g.growth++
+		log.Println("Too many slug collisions, increasing the slug length by", g.growth)
+	}
+	g.generations, g.collided = 0, 0
+}
+
+func (g *slugGenerator) currentGrowth() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.growth
+}
+
+// slugSettings returns the slug config with defaults applied
+func (a *app) slugSettings() slugConfig {
+	cfg := a.config().Slugs
+	if cfg.Strategy == "" {
+		cfg.Strategy = slugRandom
+	}
+	if cfg.Length <= 0 {
+		cfg.Length = defaultSlugLength
+		if cfg.Strategy == slugWords {
+			cfg.Length = defaultWordCount
+		}
+	}
+	if cfg.Alphabet == "" {
+		cfg.Alphabet = defaultSlugAlphabet
+	}
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = 10
+	}
+	return cfg
+}
+
+// initSlugGenerator validates the slug config and loads the word list.
+func (a *app) initSlugGenerator() error {
+	cfg := a.slugSettings()
+	switch cfg.Strategy {
+	case slugRandom, slugPronounceable, slugWords, slugSequence, slugHash:
+	default:
+		return fmt.Errorf("unknown slug strategy %q", cfg.Strategy)
+	}
+	if len(uniqueRunes(cfg.Alphabet)) < 2 {
+		return errors.New("the slug alphabet needs at least two different characters")
+	}
+	list := defaultWordList
+	if cfg.WordList != "" {
+		content, err := os.ReadFile(cfg.WordList)
+		if err != nil {
+			return err
+		}
+		list = string(content)
+	}
+	words := strings.Fields(list)
+	if cfg.Strategy == slugWords && len(words) < 2 {
+		return errors.New("the word list needs at least two words")
+	}
+	a.slugs.mu.Lock()
+	a.slugs.words = words
+	a.slugs.mu.Unlock()
+	return nil
+}
+
+// newSlug generates a free slug for the given destination using the configured strategy
+func (a *app) newSlug(ctx context.Context, destination string) (string, error) {
+	cfg := a.slugSettings()
+	growth := a.slugs.currentGrowth()
+	for attempt := range cfg.MaxAttempts {
+		length := cfg.Length + growth
+		if attempt > 0 && attempt >= cfg.MaxAttempts/2 {
+			// Try longer slugs if the short ones are all taken
+			length++
+		}
+		slug, err := a.slugCandidate(ctx, cfg, length, destination, attempt)
+		if err != nil {
+			return "", err
+		}
+		slug = a.normalizeSlug(slug)
+		exists, err := a.slugExists(slug)
+		if err != nil {
+			return "", err
+		}
+		if !exists && !a.slugReserved(slug) {
+			a.slugs.record(attempt)
+			return slug, nil
+		}
+	}
+	a.slugs.record(cfg.MaxAttempts)
+	return "", fmt.Errorf("failed to find a free slug after %d attempts", cfg.MaxAttempts)
+}
+
+func (a *app) slugCandidate(ctx context.Context, cfg slugConfig, length int, destination string, attempt int) (string, error) {
+	switch cfg.Strategy {
+	case slugPronounceable:
+		return pronounceableSlug(length), nil
+	case slugWords:
+		a.slugs.mu.Lock()
+		words := a.slugs.words
+		a.slugs.mu.Unlock()
+		if len(words) == 0 {
+			words = strings.Fields(defaultWordList)
+		}
+		return wordSlug(words, length), nil
+	case slugSequence:
+		n, err := a.nextSequence(ctx)
+		if err != nil {
+			return "", err
+		}
+		return sequenceSlug(n, shuffleAlphabet(cfg.Alphabet, cfg.Salt), cfg.Length), nil
+	case slugHash:
+		return hashSlug(cfg.Salt+"\n"+destination+"\n"+strconv.Itoa(attempt), cfg.Alphabet, length), nil
+	default:
+		return randomSlug(cfg.Alphabet, length), nil
+	}
+}
+
+func randomSlug(alphabet string, length int) string {
+	chars := uniqueRunes(alphabet)
+	b := make([]rune, length)
+	for i := range b {
+		b[i] = chars[rand.IntN(len(chars))]
+	}
+	return string(b)
+}
+
+func pronounceableSlug(length int) string {
+	const consonants = "bcdfghjklmnprstvz"
+	const vowels = "aeiou"
+	b := make([]byte, length)
+	vowel := rand.IntN(2) == 0
+	for i := range b {
+		if vowel {
+			b[i] = vowels[rand.IntN(len(vowels))]
+		} else {
+			b[i] = consonants[rand.IntN(len(consonants))]
+		}
+		vowel = !vowel
+	}
+	return string(b)
+}
+
+func wordSlug(words []string, count int) string {
+	parts := make([]string, count)
+	for i := range parts {
+		parts[i] = words[rand.IntN(len(words))]
+	}
+	return strings.Join(parts, "-")
+}
+
+// hashSlug derives a deterministic slug from the input
+func hashSlug(input, alphabet string, length int) string {
+	chars := uniqueRunes(alphabet)
+	b := make([]rune, 0, length)
+	sum := sha256.Sum256([]byte(input))
+	for len(b) < length {
+		for _, c := range sum {
+			if len(b) == length {
+				break
+			}
+			b = append(b, chars[int(c)%len(chars)])
+		}
+		sum = sha256.Sum256(sum[:])
+	}
+	return string(b)
+}
+
+// sequenceSlug encodes a sequence number with a shuffled alphabet (similar to
+// sqids), so consecutive numbers produce unrelated looking slugs. Numbers are
+// scrambled within the space of all slugs of a length, so slugs are unique
+// and only get longer when the space is exhausted.
+func sequenceSlug(n int64, alphabet []rune, minLength int) string {
+	base := big.NewInt(int64(len(alphabet)))
+	num := big.NewInt(n)
+	length := max(minLength, 1)
+	space := new(big.Int).Exp(base, big.NewInt(int64(length)), nil)
+	for num.Cmp(space) >= 0 {
+		length++
+		space.Mul(space, base)
+	}
+	// Multiplying with a prime that isn't a factor of the space is a bijection
+	prime := big.NewInt(1_000_000_007)
+	num.Mul(num, prime).Mod(num, space)
+	b := make([]rune, length)
+	rem := new(big.Int)
+	for i := length - 1; i >= 0; i-- {
+		num.DivMod(num, base, rem)
+		b[i] = alphabet[rem.Int64()]
+	}
+	return string(b)
+}
+
+// shuffleAlphabet deterministically shuffles the alphabet using the salt
+func shuffleAlphabet(alphabet, salt string) []rune {
+	chars := uniqueRunes(alphabet)
+	seed := sha256.Sum256([]byte(salt))
+	rng := rand.New(rand.NewChaCha8(seed))
+	rng.Shuffle(len(chars), func(i, j int) {
+		chars[i], chars[j] = chars[j], chars[i]
+	})
+	return chars
+}
+
+func uniqueRunes(s string) []rune {
+	seen := map[rune]bool{}
+	var runes []rune
+	for _, r := range s {
+		if !seen[r] {
+			seen[r] = true
+			runes = append(runes, r)
+		}
+	}
+	return runes
+}
+
+// nextSequence increments and returns the persisted slug sequence
+func (a *app) nextSequence(ctx context.Context) (n int64, err error) {
+	a.write.Lock()
+	defer a.write.Unlock()
+	err = a.db.query(ctx, "INSERT INTO counter (name, value) VALUES ('slug', 1) ON CONFLICT (name) DO UPDATE SET value = counter.value + 1 RETURNING value", func(stmt resultRow) error {
+		n = stmt.ColumnInt64(0)
+		return nil
+	})
+	return
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSlugStrategies(t *testing.T) {
+	t.Run("Random with the defaults", func(t *testing.T) {
+		app := testApp(t)
+		defer closeTestApp(t, app)
+		require.NoError(t, app.initSlugGenerator())
+
+		slug, err := app.newSlug(context.Background(), "https://example.com")
+		require.NoError(t, err)
+		assert.Regexp(t, regexp.MustCompile("^[0-9a-z]{6}$"), slug)
+	})
+	t.Run("Random with custom alphabet and length", func(t *testing.T) {
+		app := testApp(t)
+		defer closeTestApp(t, app)
+		app.config().Slugs = slugConfig{Strategy: slugRandom, Length: 10, Alphabet: "ab"}
+		require.NoError(t, app.initSlugGenerator())
+
+		slug, err := app.newSlug(context.Background(), "https://example.com")
+		require.NoError(t, err)
+		assert.Regexp(t, regexp.MustCompile("^[ab]{10,11}$"), slug)
+	})
+	t.Run("Pronounceable", func(t *testing.T) {
+		slug := pronounceableSlug(8)
+		assert.Len(t, slug, 8)
+		assert.Regexp(t, regexp.MustCompile("^([aeiou][^aeiou])+$|^([^aeiou][aeiou])+$"), slug)
+	})
+	t.Run("Words", func(t *testing.T) {
+		app := testApp(t)
+		defer closeTestApp(t, app)
+		app.config().Slugs = slugConfig{Strategy: slugWords}
+		require.NoError(t, app.initSlugGenerator())
+
+		slug, err := app.newSlug(context.Background(), "https://example.com")
+		require.NoError(t, err)
+		assert.Len(t, strings.Split(slug, "-"), defaultWordCount)
+	})
+	t.Run("Sequence", func(t *testing.T) {
+		app := testApp(t)
+		defer closeTestApp(t, app)
+		app.config().Slugs = slugConfig{Strategy: slugSequence, Length: 4, Salt: "salt"}
+		require.NoError(t, app.initSlugGenerator())
+
+		first, err := app.newSlug(context.Background(), "")
+		require.NoError(t, err)
+		require.NoError(t, app.insertRedirect(first, "https://example.com", typUrl))
+		second, err := app.newSlug(context.Background(), "")
+		require.NoError(t, err)
+		assert.Len(t, first, 4)
+		assert.Len(t, second, 4)
+		assert.NotEqual(t, first, second)
+
+		// all numbers of a length map to distinct slugs and grow afterwards
+		alphabet := shuffleAlphabet("abc", "salt")
+		seen := map[string]bool{}
+		for n := range int64(9) {
+			seen[sequenceSlug(n, alphabet, 2)] = true
+		}
+		assert.Len(t, seen, 9)
+		assert.Len(t, sequenceSlug(9, alphabet, 2), 3)
+	})
+	t.Run("Hash is deterministic", func(t *testing.T) {
+		app := testApp(t)
+		defer closeTestApp(t, app)
+		app.config().Slugs = slugConfig{Strategy: slugHash, Salt: "salt"}
+		require.NoError(t, app.initSlugGenerator())
+
+		first, err := app.newSlug(context.Background(), "https://example.com")
+		require.NoError(t, err)
+		again, err := app.newSlug(context.Background(), "https://example.com")
+		require.NoError(t, err)
+		other, err := app.newSlug(context.Background(), "https://example.org")
+		require.NoError(t, err)
+		assert.Equal(t, first, again)
+		assert.NotEqual(t, first, other)
+
+		// a taken slug results in the next deterministic candidate
+		require.NoError(t, app.insertRedirect(first, "https://example.com", typUrl))
+		next, err := app.newSlug(context.Background(), "https://example.com")
+		require.NoError(t, err)
+		assert.NotEqual(t, first, next)
+	})
+	t.Run("Bounded retries and length growth", func(t *testing.T) {
+		app := testApp(t)
+		defer closeTestApp(t, app)
+		// Only two possible slugs of length one, each length two slug collides on first try
+		app.config().Slugs = slugConfig{Strategy: slugRandom, Length: 1, Alphabet: "ab", MaxAttempts: 2}
+		require.NoError(t, app.insertRedirect("a", "https://example.com", typUrl))
+		require.NoError(t, app.insertRedirect("b", "https://example.com", typUrl))
+		for _, s := range []string{"aa", "ab", "ba", "bb"} {
+			require.NoError(t, app.insertRedirect(s, "https://example.com", typUrl))
+		}
+
+		_, err := app.newSlug(context.Background(), "")
+		assert.ErrorContains(t, err, "failed to find a free slug")
+
+		for range slugCollisionWindow {
+			_, _ = app.newSlug(context.Background(), "")
+		}
+		assert.Equal(t, 1, app.slugs.currentGrowth())
+
+		slug, err := app.newSlug(context.Background(), "")
+		require.NoError(t, err)
+		assert.GreaterOrEqual(t, len(slug), 2)
+	})
+	t.Run("Invalid config", func(t *testing.T) {
+		app := newApp(&config{Slugs: slugConfig{Strategy: "unknown"}})
+		assert.Error(t, app.initSlugGenerator())
+		app.config().Slugs = slugConfig{Alphabet: "aaa"}
+		assert.Error(t, app.initSlugGenerator())
+	})
+}
@@ -0,0 +1,22 @@
+// The service worker makes GoShort installable and keeps the app assets
+// available offline. Pages and API requests always go to the server.
+const cacheName = 'goshort-v1';
+const assets = ['/manifest.webmanifest', '/icon.svg', '/icon-192.png', '/icon-512.png'];
+
+self.addEventListener('install', (event) => {
+    event.waitUntil(caches.open(cacheName).then((cache) => cache.addAll(assets)).then(() => self.skipWaiting()));
+});
+
+self.addEventListener('activate', (event) => {
+    event.waitUntil(caches.keys()
+        .then((keys) => Promise.all(keys.filter((key) => key !== cacheName).map((key) => caches.delete(key))))
+        .then(() => self.clients.claim()));
+});
+
+self.addEventListener('fetch', (event) => {
+    const url = new URL(event.request.url);
+    if (event.request.method !== 'GET' || url.origin !== location.origin || !assets.includes(url.pathname)) {
+        return;
+    }
+    event.respondWith(caches.match(event.request).then((cached) => cached || fetch(event.request)));
+});
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"context"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitemigration"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// storage is a database backend. Links and clicks are stored and queried with
+// typed methods, each backend has its own SQL for them. The other tables are
+// accessed with exec and query, which use ? placeholders and the SQL supported
+// by both SQLite and PostgreSQL (the PostgreSQL schema adds unixepoch() like in SQLite).
+type storage interface {
+	// exec runs a statement and returns the number of changed rows
+	exec(ctx context.Context, query string, args ...any) (changes int, err error)
+	// query runs a query and calls resultFunc for every row
+	query(ctx context.Context, query string, resultFunc func(stmt resultRow) error, args ...any) error
+	// insertLink stores a new link
+	insertLink(ctx context.Context, slug, url, typ string) error
+	// findLink returns the slug of an active link with the destination and type, "" if there is none
+	findLink(ctx context.Context, url, typ string) (slug string, err error)
+	// resolveLink returns the active link of a slug or alias, the link has an empty url if there is none
+	resolveLink(ctx context.Context, slug string) (*storedLink, error)
+	// listLinks returns all active links with their aliases and check results
+	listLinks(ctx context.Context, order linkOrder, desc bool) ([]*storedLink, error)
+	// brokenLinks returns the active URL links whose last check failed, most recently checked first
+	brokenLinks(ctx context.Context) ([]*storedLink, error)
+	// saveCheckResult stores the result of the health check of a link
+	saveCheckResult(ctx context.Context, slug string, res *checkResult) error
+	// recordClicks stores single clicks and increases the hit counters of their links
+	recordClicks(ctx context.Context, clicks []click) error
+	// rollupClicks folds the single clicks of the days before a day number into
+	// daily statistics with the top referrers of every day and deletes them
+	rollupClicks(ctx context.Context, beforeDay int64, topReferrers int) (rolledUp int, err error)
+	// dailyClicks returns the clicks and visitors of a link per day since a day number, newest first
+	dailyClicks(ctx context.Context, slug string, fromDay int64) ([]dayClicks, error)
+	// topReferrers returns the referrers with the most clicks on a link since a day number
+	topReferrers(ctx context.Context, slug string, fromDay int64, limit int) ([]referrerClicks, error)
+	// transaction runs fn in a transaction (or savepoint if nested), which is rolled back if fn returns an error
+	transaction(ctx context.Context, fn func(tx storage) error) error
+	// migrate updates the schema to the current version
+	migrate(ctx context.Context) error
+	close() error
+}
+
+// resultRow is a result row of a query
+type resultRow interface {
+	ColumnText(col int) string
+	ColumnInt(col int) int
+	ColumnInt64(col int) int64
+	ColumnBool(col int) bool
+}
+
+// storedLink is a link as stored in the redirect table
+type storedLink struct {
+	slug, url, typ string
+	hits           int
+	// aliases of the link separated by commas
+	aliases string
+	// result of the last health check and when it ran, zero if never checked
+	check   checkResult
+	checked time.Time
+}
+
+// linkColumns are the columns of the redirect table read by scanLink
+const linkColumns = "slug, url, type, hits, check_status, check_error, check_latency, check_time"
+
+// scanLink reads the linkColumns of a row, followed by the aliases if withAliases is set
+func scanLink(stmt resultRow, withAliases bool) *storedLink {
+	l := &storedLink{
+		slug:  stmt.ColumnText(0),
+		url:   stmt.ColumnText(1),
+		typ:   stmt.ColumnText(2),
+		hits:  stmt.ColumnInt(3),
+		check: checkResult{Status: stmt.ColumnInt(4), Error: stmt.ColumnText(5), Latency: time.Duration(stmt.ColumnInt64(6)) * time.Millisecond},
+	}
+	if t := stmt.ColumnInt64(7); t > 0 {
+		l.checked = time.Unix(t, 0)
+	}
+	if withAliases {
+		l.aliases = stmt.ColumnText(8)
+	}
+	return l
+}
+
+// linkOrder is the column the list of links is sorted by
+type linkOrder string
+
+const (
+	orderCreated linkOrder = "created"
+	orderSlug    linkOrder = "slug"
+	orderHits    linkOrder = "hits"
+	orderURL     linkOrder = "url"
+)
+
+// orderBy returns the ORDER BY expression of the order, unknown orders sort by creation
+func (o linkOrder) orderBy(desc bool) string {
+	expr := "created"
+	switch o {
+	case orderSlug:
+		expr = "lower(slug)"
+	case orderHits:
+		expr = "hits"
+	case orderURL:
+		expr = "lower(url)"
+	}
+	if desc {
+		return expr + " DESC"
+	}
+	return expr + " ASC"
+}
+
+// dayClicks are the clicks and unique visitors of a link on a day
+type dayClicks struct {
+	day              int64
+	clicks, visitors int64
+}
+
+// referrerClicks are the clicks on a link from a referring host
+type referrerClicks struct {
+	host   string
+	clicks int64
+}
+
+// clickCounts returns the number of clicks per link, sorted by slug so that
+// concurrent updates of the hit counters lock the rows in the same order
+func clickCounts(clicks []click) (slugs []string, counts map[string]int) {
+	counts = map[string]int{}
+	for _, c := range clicks {
+		counts[c.slug]++
+	}
+	return slices.Sorted(maps.Keys(counts)), counts
+}
+
+type sqliteStorage struct {
+	pool *sqlitex.Pool
+	// set for transactions
+	conn *sqlite.Conn
+}
+
+func openSQLite(path string) (*sqliteStorage, error) {
+	_ = os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	pool, err := sqlitex.NewPool(path, sqlitex.PoolOptions{
+		Flags:    sqlite.OpenCreate | sqlite.OpenReadWrite | sqlite.OpenWAL,
+		PoolSize: 10,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &sqliteStorage{pool: pool}, nil
+}
+
+func (s *sqliteStorage) take(ctx context.Context) (*sqlite.Conn, func(), error) {
+	if s.conn != nil {
+		return s.conn, func() {}, nil
+	}
+	conn, err := s.pool.Take(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn, func() { s.pool.Put(conn) }, nil
+}
+
+func (s *sqliteStorage) exec(ctx context.Context, query string, args ...any) (int, error) {
+	conn, put, err := s.take(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer put()
+	if err := sqlitex.Execute(conn, query, &sqlitex.ExecOptions{Args: args}); err != nil {
+		return 0, err
+	}
+	return conn.Changes(), nil
+}
+
+func (s *sqliteStorage) query(ctx context.Context, query string, resultFunc func(stmt resultRow) error, args ...any) error {
+	conn, put, err := s.take(ctx)
+	if err != nil {
+		return err
+	}
+	defer put()
+	return sqlitex.Execute(conn, query, &sqlitex.ExecOptions{
+		Args: args,
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			return resultFunc(stmt)
+		},
+	})
+}
+
+func (s *sqliteStorage) transaction(ctx context.Context, fn func(tx storage) error) (err error) {
+	conn, put, err := s.take(ctx)
+	if err != nil {
+		return err
+	}
+	defer put()
+	defer sqlitex.Save(conn)(&err)
+	return fn(&sqliteStorage{pool: s.pool, conn: conn})
+}
+
+func (s *sqliteStorage) close() error {
+	return s.pool.Close()
+}
+
+func (s *sqliteStorage) insertLink(ctx context.Context, slug, url, typ string) error {
+	_, err := s.exec(ctx, "INSERT INTO redirect (slug, url, type, created) VALUES (?, ?, ?, unixepoch())", slug, url, typ)
+	return err
+}
+
+func (s *sqliteStorage) findLink(ctx context.Context, url, typ string) (slug string, err error) {
+	err = s.query(ctx, "SELECT slug FROM redirect WHERE url = ? AND type = ? AND deleted IS NULL LIMIT 1", func(stmt resultRow) error {
+		slug = stmt.ColumnText(0)
+		return nil
+	}, url, typ)
+	return
+}
+
+func (s *sqliteStorage) resolveLink(ctx context.Context, slug string) (*storedLink, error) {
+	link := &storedLink{}
+	err := s.query(ctx, "SELECT "+linkColumns+" FROM redirect WHERE slug = coalesce((SELECT link FROM alias WHERE slug = ?), ?) AND deleted IS NULL", func(stmt resultRow) error {
+		link = scanLink(stmt, false)
+		return nil
+	}, slug, slug)
+	return link, err
+}
+
+func (s *sqliteStorage) listLinks(ctx context.Context, order linkOrder, desc bool) (links []*storedLink, err error) {
+	err = s.query(ctx, "SELECT "+linkColumns+", (SELECT group_concat(alias.slug, ', ') FROM alias WHERE alias.link = redirect.slug) FROM redirect WHERE deleted IS NULL ORDER BY "+order.orderBy(desc), func(stmt resultRow) error {
+		links = append(links, scanLink(stmt, true))
+		return nil
+	})
+	return
+}
+
+func (s *sqliteStorage) brokenLinks(ctx context.Context) (links []*storedLink, err error) {
+	err = s.query(ctx, "SELECT "+linkColumns+" FROM redirect WHERE type = 'url' AND deleted IS NULL AND (check_error != '' OR check_status >= 400) ORDER BY check_time DESC", func(stmt resultRow) error {
+		links = append(links, scanLink(stmt, false))
+		return nil
+	})
+	return
+}
+
+func (s *sqliteStorage) saveCheckResult(ctx context.Context, slug string, res *checkResult) error {
+	_, err := s.exec(ctx, "UPDATE redirect SET check_status = ?, check_latency = ?, check_error = ?, check_time = unixepoch() WHERE slug = ?", res.Status, res.Latency.Milliseconds(), res.Error, slug)
+	return err
+}
+
+func (s *sqliteStorage) recordClicks(ctx context.Context, clicks []click) error {
+	return s.transaction(ctx, func(tx storage) error {
+		for _, c := range clicks {
+			if _, err := tx.exec(ctx, "INSERT INTO click (slug, created, visitor, referrer) VALUES (?, ?, ?, ?)", c.slug, c.time, c.visitor, c.referrer); err != nil {
+				return err
+			}
+		}
+		slugs, counts := clickCounts(clicks)
+		for _, slug := range slugs {
+			if _, err := tx.exec(ctx, "UPDATE redirect SET hits = hits + ? WHERE slug = ?", counts[slug], slug); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *sqliteStorage) rollupClicks(ctx context.Context, beforeDay int64, topReferrers int) (rolledUp int, err error) {
+	before := beforeDay * secondsPerDay
+	err = s.transaction(ctx, func(tx storage) error {
+		_, err := tx.exec(ctx, `INSERT INTO click_daily (slug, day, clicks, visitors)
+			SELECT slug, created / 86400, count(*), count(DISTINCT visitor) FROM click WHERE created < ? GROUP BY slug, created / 86400
+			ON CONFLICT (slug, day) DO UPDATE SET clicks = click_daily.clicks + excluded.clicks, visitors = click_daily.visitors + excluded.visitors`, before)
+		if err != nil {
+			return err
+		}
+		_, err = tx.exec(ctx, `INSERT INTO click_referrer (slug, day, referrer, clicks)
+			SELECT slug, day, referrer, clicks FROM (
+				SELECT slug, created / 86400 AS day, referrer, count(*) AS clicks, row_number() OVER (PARTITION BY slug, created / 86400 ORDER BY count(*) DESC, referrer) AS n
+				FROM click WHERE created < ? AND referrer != '' GROUP BY slug, created / 86400, referrer
+			) WHERE n <= ?
+			ON CONFLICT (slug, day, referrer) DO UPDATE SET clicks = click_referrer.clicks + excluded.clicks`, before, topReferrers)
+		if err != nil {
+			return err
+		}
+		rolledUp, err = tx.exec(ctx, "DELETE FROM click WHERE created < ?", before)
+		return err
+	})
+	return
+}
+
+func (s *sqliteStorage) dailyClicks(ctx context.Context, slug string, fromDay int64) (days []dayClicks, err error) {
+	// Days that are rolled up already and days with single clicks are combined
+	err = s.query(ctx, `SELECT day, sum(clicks), sum(visitors) FROM (
+			SELECT day, clicks, visitors FROM click_daily WHERE slug = ? AND day >= ?
+			UNION ALL
+			SELECT created / 86400 AS day, count(*) AS clicks, count(DISTINCT visitor) AS visitors FROM click WHERE slug = ? AND created >= ? GROUP BY created / 86400
+		) GROUP BY day ORDER BY day DESC`, func(stmt resultRow) error {
+		days = append(days, dayClicks{day: stmt.ColumnInt64(0), clicks: stmt.ColumnInt64(1), visitors: stmt.ColumnInt64(2)})
+		return nil
+	}, slug, fromDay, slug, fromDay*secondsPerDay)
+	return
+}
+
+func (s *sqliteStorage) topReferrers(ctx context.Context, slug string, fromDay int64, limit int) (referrers []referrerClicks, err error) {
+	err = s.query(ctx, `SELECT referrer, sum(clicks) AS total FROM (
+			SELECT referrer, clicks FROM click_referrer WHERE slug = ? AND day >= ?
+			UNION ALL
+			SELECT referrer, count(*) AS clicks FROM click WHERE slug = ? AND created >= ? AND referrer != '' GROUP BY referrer
+		) GROUP BY referrer ORDER BY total DESC, referrer LIMIT ?`, func(stmt resultRow) error {
+		referrers = append(referrers, referrerClicks{host: stmt.ColumnText(0), clicks: stmt.ColumnInt64(1)})
+		return nil
+	}, slug, fromDay, slug, fromDay*secondsPerDay, limit)
+	return
+}
+
+// sqliteSchema is the schema of the SQLite database, the AppID and the number of
+// migrations are stored in the database file
+var sqliteSchema = sqlitemigration.Schema{
+	AppID: 0x1bd6d04a,
+	Migrations: []string{
+		`
+		drop table if exists gorp_migrations;
+		create table if not exists redirect(slug text not null primary key, url text not null, type text not null default 'url', hits integer default 0 not null);
+		insert or replace into redirect (slug, url) values ('source', 'https://git.jlel.se/jlelse/GoShort');
+		`,
+		`
+		update redirect set url = 'https://github.com/jlelse/GoShort' where slug = 'source';
+		`,
+		`
+		alter table redirect add column created integer;
+		update redirect set created = strftime('%s','now') where created is null;
+		`,
+		`
+		create table if not exists revision(id integer primary key autoincrement, slug text not null, url text not null, type text not null, created integer not null);
+		create index if not exists revision_slug on revision(slug);
+		`,
+		`
+		alter table redirect add column deleted integer;
+		`,
+		`
+		alter table redirect add column check_status integer;
+		alter table redirect add column check_latency integer;
+		alter table redirect add column check_error text;
+		alter table redirect add column check_time integer;
+		`,
+		`
+		create table if not exists counter(name text not null primary key, value integer not null);
+		`,
+		`
+		create table if not exists alias(slug text not null primary key, link text not null);
+		create index if not exists alias_link on alias(link);
+		`,
+		`
+		create table if not exists click(slug text not null, created integer not null, visitor text not null, referrer text not null);
+		create index if not exists click_slug_created on click(slug, created);
+		create index if not exists click_created on click(created);
+		create table if not exists click_daily(slug text not null, day integer not null, clicks integer not null, visitors integer not null, primary key (slug, day));
+		create table if not exists click_referrer(slug text not null, day integer not null, referrer text not null, clicks integer not null, primary key (slug, day, referrer));
+		`,
+		`
+		create table if not exists session(id text not null primary key, created integer not null, expires integer not null);
+		create index if not exists session_expires on session(expires);
+		`,
+		`
+		alter table session add column username text not null default '';
+		alter table session add column role text not null default 'admin';
+		`,
+		`
+		create table if not exists visitor_salt(day integer not null primary key, salt text not null);
+		`,
+	},
+}
+
+func (s *sqliteStorage) migrate(ctx context.Context) error {
+	conn, err := s.pool.Take(ctx)
+	if err != nil {
+		return err
+	}
+	defer s.pool.Put(conn)
+	return sqlitemigration.Migrate(ctx, conn, sqliteSchema)
+}
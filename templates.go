@@ -10,9 +10,16 @@ import (
 var listTemplate *template.Template
 var urlFormTemplate *template.Template
 var textFormTemplate *template.Template
+var historyTemplate *template.Template
+var trashTemplate *template.Template
+var brokenTemplate *template.Template
+var statsTemplate *template.Template
+var docsTemplate *template.Template
+var shareTemplate *template.Template
+var loginTemplate *template.Template
 
 func init() {
-	if initListTemplate() != nil || initURLFormTemplate() != nil || initTextFormTemplate() != nil {
+	if initListTemplate() != nil || initURLFormTemplate() != nil || initTextFormTemplate() != nil || initHistoryTemplate() != nil || initTrashTemplate() != nil || initBrokenTemplate() != nil || initStatsTemplate() != nil || initDocsTemplate() != nil || initShareTemplate() != nil || initLoginTemplate() != nil {
 		log.Fatal("Failed to initialize templates")
 		return
 	}
@@ -20,6 +27,7 @@ func init() {
 
 type templateData struct {
 	Style template.CSS
+	CSRF  string
 	Data  any
 }
 
@@ -47,5 +55,61 @@ func initTextFormTemplate() (err error) {
 	return
 }
 
+//go:embed templates/history.gohtml
+var historyTemplateString string
+
+func initHistoryTemplate() (err error) {
+	historyTemplate, err = template.New("History").Parse(strings.TrimSpace(historyTemplateString))
+	return
+}
+
+//go:embed templates/trash.gohtml
+var trashTemplateString string
+
+func initTrashTemplate() (err error) {
+	trashTemplate, err = template.New("Trash").Parse(strings.TrimSpace(trashTemplateString))
+	return
+}
+
+//go:embed templates/broken.gohtml
+var brokenTemplateString string
+
+func initBrokenTemplate() (err error) {
+	brokenTemplate, err = template.New("Broken").Parse(strings.TrimSpace(brokenTemplateString))
+	return
+}
+
+//go:embed templates/stats.gohtml
+var statsTemplateString string
+
+func initStatsTemplate() (err error) {
+	statsTemplate, err = template.New("Stats").Parse(strings.TrimSpace(statsTemplateString))
+	return
+}
+
+//go:embed templates/docs.gohtml
+var docsTemplateString string
+
+func initDocsTemplate() (err error) {
+	docsTemplate, err = template.New("Docs").Parse(strings.TrimSpace(docsTemplateString))
+	return
+}
+
+//go:embed templates/share.gohtml
+var shareTemplateString string
+
+func initShareTemplate() (err error) {
+	shareTemplate, err = template.New("Share").Parse(strings.TrimSpace(shareTemplateString))
+	return
+}
+
+//go:embed templates/login.gohtml
+var loginTemplateString string
+
+func initLoginTemplate() (err error) {
+	loginTemplate, err = template.New("Login").Parse(strings.TrimSpace(loginTemplateString))
+	return
+}
+
 //go:embed static/style.css
 var styleCSS string
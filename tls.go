@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+type tlsConfig struct {
+	// Certificate and key files, reloaded when they change
+	CertFile string `mapstructure:"certFile"`
+	KeyFile  string `mapstructure:"keyFile"`
+	// Get certificates automatically using ACME (Let's Encrypt by default)
+	Acme bool `mapstructure:"acme"`
+	// Domains to get certificates for, the domain of shortUrl if empty
+	Domains []string `mapstructure:"domains"`
+	// Contact email for the ACME account
+	Email string `mapstructure:"email"`
+	// ACME directory URL, e.g. of a test server like Pebble
+	AcmeDirectory string `mapstructure:"acmeDirectory"`
+	// File with additional root certificates to trust for the ACME directory
+	AcmeRootCA string `mapstructure:"acmeRootCA"`
+	// Port for a listener redirecting HTTP to HTTPS (and solving ACME HTTP challenges), 0 disables it
+	RedirectPort int `mapstructure:"redirectPort"`
+}
+
+func (c tlsConfig) enabled() bool {
+	return c.Acme || c.CertFile != ""
+}
+
+// initTLS returns the TLS config for the server and the handler for the HTTP
+// redirect listener. Both are nil if TLS isn't configured.
+func (a *app) initTLS() (*tls.Config, http.Handler, error) {
+	cfg := a.config().TLS
+	if !cfg.enabled() {
+		return nil, nil, nil
+	}
+	redirect := httpsRedirect(a.config().Port)
+	if !cfg.Acme {
+		if cfg.KeyFile == "" {
+			return nil, nil, errors.New("tls.keyFile is required with tls.certFile")
+		}
+		certs := &certReloader{certFile: cfg.CertFile, keyFile: cfg.KeyFile}
+		if _, err := certs.getCertificate(nil); err != nil {
+			return nil, nil, err
+		}
+		return &tls.Config{GetCertificate: certs.getCertificate, MinVersion: tls.VersionTLS12}, redirect, nil
+	}
+
+	domains := cfg.Domains
+	if len(domains) == 0 {
+		u, err := url.Parse(a.config().ShortUrl)
+		if err != nil || u.Hostname() == "" {
+			return nil, nil, errors.New("tls.domains is required if shortUrl has no domain")
+		}
+		domains = []string{u.Hostname()}
+	}
+	client := &acme.Client{DirectoryURL: cfg.AcmeDirectory}
+	if cfg.AcmeRootCA != "" {
+		pem, err := os.ReadFile(cfg.AcmeRootCA)
+		if err != nil {
+			return nil, nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, nil, fmt.Errorf("no certificates found in %s", cfg.AcmeRootCA)
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+		client.HTTPClient = &http.Client{Transport: transport}
+	}
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(a.certDir()),
+		HostPolicy: autocert.HostWhitelist(domains...),
+		Email:      cfg.Email,
+		Client:     client,
+	}
+	return manager.TLSConfig(), manager.HTTPHandler(redirect), nil
+}
+
+// certDir is where ACME certificates are stored, next to the database
+func (a *app) certDir() string {
+	return filepath.Join(filepath.Dir(a.config().DBPath), "certs")
+}
+
+// httpsRedirect redirects requests to the same URL using HTTPS on the given port
+func httpsRedirect(port int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if port != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(port))
+		}
+		target := url.URL{Scheme: "https", Host: host, Path: r.URL.Path, RawQuery: r.URL.RawQuery}
+		http.Redirect(w, r, target.String(), http.StatusMovedPermanently)
+	})
+}
+
+// startRedirectServer starts the HTTP listener redirecting to HTTPS
+func (a *app) startRedirectServer(handler http.Handler) {
+	port := a.config().TLS.RedirectPort
+	if handler == nil || port == 0 {
+		return
+	}
+	server := &http.Server{
+		Addr:         ":" + strconv.Itoa(port),
+		Handler:      handler,
+		ReadTimeout:  time.Minute,
+		WriteTimeout: time.Minute,
+	}
+	a.shutdown.Add(func() {
+		toc, c := context.WithTimeout(context.Background(), 5*time.Second)
+		defer c()
+		if err := server.Shutdown(toc); err != nil {
+			log.Println("Error on redirect server shutdown:", err.Error())
+		}
+	})
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Println("Failed to start HTTP redirect server:", err.Error())
+		}
+	}()
+}
+
+// certReloader loads a certificate and reloads it when the files change
+type certReloader struct {
+	certFile, keyFile string
+	mu                sync.Mutex
+	cert              *tls.Certificate
+	modified          time.Time
+}
+
+func (c *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	modified := c.modified
+	for _, file := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			if c.cert != nil {
+				// Keep the loaded certificate, the files might be replaced right now
+				return c.cert, nil
+			}
+			return nil, err
+		}
+		if info.ModTime().After(modified) {
+			modified = info.ModTime()
+		}
+	}
+	if c.cert != nil && !modified.After(c.modified) {
+		return c.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		if c.cert != nil {
+			log.Println("Failed to reload certificate:", err.Error())
+			return c.cert, nil
+		}
+		return nil, err
+	}
+	c.cert, c.modified = &cert, modified
+	return c.cert, nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestCert writes a self-signed certificate for localhost with the given serial number
+func writeTestCert(t *testing.T, certFile, keyFile string, serial int64) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600))
+}
+
+func TestStaticCertificate(t *testing.T) {
+	t.Run("Serves and reloads static certificates", func(t *testing.T) {
+		dir := t.TempDir()
+		certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+		writeTestCert(t, certFile, keyFile, 1)
+
+		app := testApp(t)
+		defer closeTestApp(t, app)
+		app.config().Port = 8443
+		app.config().TLS = tlsConfig{CertFile: certFile, KeyFile: keyFile}
+
+		tlsConfig, redirect, err := app.initTLS()
+		require.NoError(t, err)
+		require.NotNil(t, redirect)
+
+		listener, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+		require.NoError(t, err)
+		server := &http.Server{Handler: app.initRouter()}
+		go func() { _ = server.Serve(listener) }()
+		defer server.Close()
+
+		serial := func() int64 {
+			client := &http.Client{
+				Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, DisableKeepAlives: true},
+				CheckRedirect: func(*http.Request, []*http.Request) error {
+					return http.ErrUseLastResponse
+				},
+			}
+			resp, err := client.Get("https://" + listener.Addr().String() + "/source")
+			require.NoError(t, err)
+			_ = resp.Body.Close()
+			assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+			return resp.TLS.PeerCertificates[0].SerialNumber.Int64()
+		}
+		assert.Equal(t, int64(1), serial())
+
+		// replaced certificates are picked up
+		writeTestCert(t, certFile, keyFile, 2)
+		future := time.Now().Add(time.Minute)
+		require.NoError(t, os.Chtimes(certFile, future, future))
+		assert.Equal(t, int64(2), serial())
+
+		// the redirect listener points to HTTPS
+		req := httptest.NewRequest("GET", "http://example.com:8080/source?a=b", nil)
+		w := httptest.NewRecorder()
+		redirect.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusMovedPermanently, w.Code)
+		assert.Equal(t, "https://example.com:8443/source?a=b", w.Header().Get("Location"))
+
+		w = httptest.NewRecorder()
+		httpsRedirect(443).ServeHTTP(w, req)
+		assert.Equal(t, "https://example.com/source?a=b", w.Header().Get("Location"))
+	})
+	t.Run("Invalid configs", func(t *testing.T) {
+		app := testApp(t)
+		defer closeTestApp(t, app)
+		app.config().TLS = tlsConfig{CertFile: filepath.Join(t.TempDir(), "missing.pem")}
+		_, _, err := app.initTLS()
+		assert.Error(t, err)
+		app.config().TLS.KeyFile = filepath.Join(t.TempDir(), "missing.pem")
+		_, _, err = app.initTLS()
+		assert.Error(t, err)
+		app.config().TLS = tlsConfig{}
+		tlsConfig, redirect, err := app.initTLS()
+		assert.NoError(t, err)
+		assert.Nil(t, tlsConfig)
+		assert.Nil(t, redirect)
+	})
+}
+
+// TestAcmeCertificate needs a running ACME test server, e.g. Pebble started with
+// PEBBLE_VA_ALWAYS_VALID=1, and the environment variables GOSHORT_TEST_ACME_DIRECTORY
+// (like https://localhost:14000/dir) and GOSHORT_TEST_ACME_ROOT_CA (Pebble's minica.pem).
+func TestAcmeCertificate(t *testing.T) {
+	directory, rootCA := os.Getenv("GOSHORT_TEST_ACME_DIRECTORY"), os.Getenv("GOSHORT_TEST_ACME_ROOT_CA")
+	if directory == "" || rootCA == "" {
+		t.Skip("no ACME test server configured")
+	}
+
+	app := testApp(t)
+	defer closeTestApp(t, app)
+	app.config().ShortUrl = "https://goshort.test"
+	app.config().TLS = tlsConfig{Acme: true, AcmeDirectory: directory, AcmeRootCA: rootCA, Email: "test@goshort.test"}
+
+	tlsConfig, _, err := app.initTLS()
+	require.NoError(t, err)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	require.NoError(t, err)
+	server := &http.Server{Handler: app.initRouter()}
+	go func() { _ = server.Serve(listener) }()
+	defer server.Close()
+
+	conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{ServerName: "goshort.test", InsecureSkipVerify: true})
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, []string{"goshort.test"}, conn.ConnectionState().PeerCertificates[0].DNSNames)
+
+	// the certificate is stored next to the database
+	_, err = os.Stat(filepath.Join(app.certDir(), "goshort.test"))
+	assert.NoError(t, err)
+}
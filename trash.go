@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// restoreSlug moves a slug out of the trash
+func (a *app) restoreSlug(slug string) error {
+	a.write.Lock()
+	defer a.write.Unlock()
+	_, err := a.db.exec(context.Background(), "UPDATE redirect SET deleted = NULL WHERE slug = ?", slug)
+	// Aliases of the link might be cached as unknown
+	a.cache.clear()
+	return err
+}
+
+// purgeSlug permanently deletes a slug in the trash including its history
+func (a *app) purgeSlug(slug string) error {
+	a.write.Lock()
+	defer a.write.Unlock()
+	ctx := context.Background()
+	return a.db.transaction(ctx, func(tx storage) error {
+		for _, query := range []string{
+			"DELETE FROM revision WHERE slug IN (SELECT slug FROM redirect WHERE slug = ? AND deleted IS NOT NULL)",
+			"DELETE FROM alias WHERE link IN (SELECT slug FROM redirect WHERE slug = ? AND deleted IS NOT NULL)",
+			"DELETE FROM click WHERE slug IN (SELECT slug FROM redirect WHERE slug = ? AND deleted IS NOT NULL)",
+			"DELETE FROM click_daily WHERE slug IN (SELECT slug FROM redirect WHERE slug = ? AND deleted IS NOT NULL)",
+			"DELETE FROM click_referrer WHERE slug IN (SELECT slug FROM redirect WHERE slug = ? AND deleted IS NOT NULL)",
+			"DELETE FROM redirect WHERE slug = ? AND deleted IS NOT NULL",
+		} {
+			if _, err := tx.exec(ctx, query, slug); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// purgeTrash permanently deletes all slugs moved to the trash before the given time
+func (a *app) purgeTrash(before time.Time) (purged int, err error) {
+	a.write.Lock()
+	defer a.write.Unlock()
+	ctx := context.Background()
+	err = a.db.transaction(ctx, func(tx storage) error {
+		for _, query := range []string{
+			"DELETE FROM revision WHERE slug IN (SELECT slug FROM redirect WHERE deleted <= ?)",
+			"DELETE FROM alias WHERE link IN (SELECT slug FROM redirect WHERE deleted <= ?)",
+			"DELETE FROM click WHERE slug IN (SELECT slug FROM redirect WHERE deleted <= ?)",
+			"DELETE FROM click_daily WHERE slug IN (SELECT slug FROM redirect WHERE deleted <= ?)",
+			"DELETE FROM click_referrer WHERE slug IN (SELECT slug FROM redirect WHERE deleted <= ?)",
+		} {
+			if _, err := tx.exec(ctx, query, before.Unix()); err != nil {
+				return err
+			}
+		}
+		purged, err = tx.exec(ctx, "DELETE FROM redirect WHERE deleted <= ?", before.Unix())
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return purged, nil
+}
+
+// slugInTrash reports whether a slug exists and is in the trash
+func (a *app) slugInTrash(slug string) (trashed bool, err error) {
+	err = a.db.query(context.Background(), "SELECT EXISTS(SELECT 1 FROM redirect WHERE slug = ? AND deleted IS NOT NULL)", func(stmt resultRow) error {
+		trashed = stmt.ColumnBool(0)
+		return nil
+	}, slug)
+	return
+}
+
+// startTrashPurger starts a background worker that permanently deletes links
+// which have been in the trash for longer than the configured retention.
+func (a *app) startTrashPurger() {
+	if a.config().TrashRetention <= 0 {
+		return
+	}
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Go(func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+		for {
+			purged, err := a.purgeTrash(time.Now().Add(-a.config().TrashRetention))
+			if err != nil {
+				log.Println("Failed to purge trash:", err.Error())
+			} else if purged > 0 {
+				log.Println("Purged", purged, "links from the trash")
+			}
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	})
+	a.shutdown.Add(func() {
+		close(stop)
+		wg.Wait()
+	})
+}
+
+func (a *app) trashHandler(w http.ResponseWriter, r *http.Request) {
+	type row struct {
+		Slug    string
+		URL     string
+		Type    string
+		Hits    int
+		Created string
+		Deleted string
+		Purge   string
+	}
+	var list []row
+
+	formatTime := func(unix int64) string {
+		if unix == 0 {
+			return ""
+		}
+		return time.Unix(unix, 0).UTC().Format(time.DateTime)
+	}
+
+	err := a.db.query(r.Context(), "SELECT slug, url, type, hits, created, deleted FROM redirect WHERE deleted IS NOT NULL ORDER BY deleted DESC", func(stmt resultRow) error {
+		deleted := stmt.ColumnInt64(5)
+		r := row{
+			Slug:    stmt.ColumnText(0),
+			URL:     stmt.ColumnText(1),
+			Type:    stmt.ColumnText(2),
+			Hits:    stmt.ColumnInt(3),
+			Created: formatTime(stmt.ColumnInt64(4)),
+			Deleted: formatTime(deleted),
+		}
+		if a.config().TrashRetention > 0 {
+			r.Purge = formatTime(time.Unix(deleted, 0).Add(a.config().TrashRetention).Unix())
+		}
+		list = append(list, r)
+		return nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = trashTemplate.Execute(w, &templateData{Style: template.CSS(styleCSS), CSRF: a.csrfToken(r), Data: map[string]any{
+		"List": list,
+	}})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (a *app) restoreHandler(w http.ResponseWriter, r *http.Request) {
+	slug := a.requestSlug(r)
+	if slug == "" {
+		http.Error(w, "Specify the slug to restore", http.StatusBadRequest)
+		return
+	}
+
+	if e, err := a.slugInTrash(slug); !e || err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if err := a.restoreSlug(slug); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	_, _ = io.WriteString(w, "Slug restored")
+}
+
+func (a *app) purgeHandler(w http.ResponseWriter, r *http.Request) {
+	slug := a.requestSlug(r)
+	if slug == "" {
+		http.Error(w, "Specify the slug to delete permanently", http.StatusBadRequest)
+		return
+	}
+
+	if e, err := a.slugInTrash(slug); !e || err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if err := a.purgeSlug(slug); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	_, _ = io.WriteString(w, "Slug deleted permanently")
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrash(t *testing.T) {
+	t.Run("Deleted links go to the trash and can be restored", func(t *testing.T) {
+		app := testApp(t)
+		defer closeTestApp(t, app)
+		app.config().Password = "abc"
+
+		router := app.initRouter()
+
+		post := func(path string, form url.Values) *http.Response {
+			form.Set("password", "abc")
+			req := httptest.NewRequest("POST", "http://example.com"+path, strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			return w.Result()
+		}
+		get := func(path string) (*http.Response, string) {
+			req := httptest.NewRequest("GET", "http://example.com"+path, nil)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			resp := w.Result()
+			body, _ := io.ReadAll(resp.Body)
+			_ = resp.Body.Close()
+			return resp, string(body)
+		}
+
+		require.NoError(t, app.insertRedirect("trashme", "https://trash.example", typUrl))
+
+		assert.Equal(t, http.StatusAccepted, post("/d", url.Values{"slug": {"trashme"}}).StatusCode)
+
+		// trashed links aren't reachable and not listed
+		resp, _ := get("/trashme")
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+		_, body := get("/l?password=abc")
+		assert.NotContains(t, body, "https://trash.example")
+
+		// deleting again isn't possible, the slug is still taken
+		assert.Equal(t, http.StatusNotFound, post("/d", url.Values{"slug": {"trashme"}}).StatusCode)
+		assert.Equal(t, http.StatusBadRequest, post("/s", url.Values{"slug": {"trashme"}, "url": {"https://other.example"}}).StatusCode)
+
+		// shortening the same URL again creates a new slug
+		resp = post("/s", url.Values{"url": {"https://trash.example"}})
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+		// trash view lists it
+		_, body = get("/trash?password=abc")
+		assert.Contains(t, body, "title=\"trashme\"")
+
+		// restore
+		assert.Equal(t, http.StatusAccepted, post("/restore", url.Values{"slug": {"trashme"}}).StatusCode)
+		assert.Equal(t, http.StatusNotFound, post("/restore", url.Values{"slug": {"trashme"}}).StatusCode)
+		resp, _ = get("/trashme")
+		assert.Equal(t, "https://trash.example", resp.Header.Get("Location"))
+
+		// permanent deletion only works from the trash
+		assert.Equal(t, http.StatusNotFound, post("/purge", url.Values{"slug": {"trashme"}}).StatusCode)
+		require.NoError(t, app.deleteSlug("trashme"))
+		assert.Equal(t, http.StatusAccepted, post("/purge", url.Values{"slug": {"trashme"}}).StatusCode)
+		exists, err := app.slugExists("trashme")
+		require.NoError(t, err)
+		assert.False(t, exists)
+	})
+	t.Run("Old links are purged from the trash", func(t *testing.T) {
+		app := testApp(t)
+		defer closeTestApp(t, app)
+
+		require.NoError(t, app.insertRedirect("old", "https://old.example", typUrl))
+		require.NoError(t, app.insertRedirect("new", "https://new.example", typUrl))
+		require.NoError(t, app.deleteSlug("old"))
+		require.NoError(t, app.deleteSlug("new"))
+
+		_, err := app.db.exec(context.Background(), "UPDATE redirect SET deleted = ? WHERE slug = ?", time.Now().Add(-48*time.Hour).Unix(), "old")
+		require.NoError(t, err)
+
+		purged, err := app.purgeTrash(time.Now().Add(-24 * time.Hour))
+		require.NoError(t, err)
+		assert.Equal(t, 1, purged)
+
+		exists, err := app.slugExists("old")
+		require.NoError(t, err)
+		assert.False(t, exists)
+		exists, err = app.slugExists("new")
+		require.NoError(t, err)
+		assert.True(t, exists)
+	})
+}